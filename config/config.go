@@ -4,11 +4,19 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
@@ -16,24 +24,251 @@ import (
 
 const (
 	certFileName = "cert.pem"
+
+	archiveDirName          = "archive"
+	liveDirName             = "live"
+	defaultArchiveRetention = 5
+
+	defaultCheckInterval = time.Hour
+
+	// Vault backdates NotBefore and truncates the dates to the second
+	shortenedTTLTolerance = time.Minute
+
+	defaultFailureBackoffBase = time.Minute
+	defaultFailureBackoffMax  = 30 * time.Minute
+
+	KeyGenerationVault = "vault"
+	KeyGenerationLocal = "local"
+
+	AuthMethodAppRole    = "approle"
+	AuthMethodToken      = "token"
+	AuthMethodKubernetes = "kubernetes"
+	AuthMethodCert       = "cert"
+
+	FormatPEM       = "pem"
+	FormatPEMBundle = "pem_bundle"
+	FormatDER       = "der"
+
+	PrivateKeyFormatDER   = "der"
+	PrivateKeyFormatPKCS8 = "pkcs8"
+
+	KeyTypeRSA     = "rsa"
+	KeyTypeEC      = "ec"
+	KeyTypeEd25519 = "ed25519"
 )
 
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+var hostSeed struct {
+	sync.Once
+	value string
+}
+
+var validKeyBits = map[string][]int{
+	KeyTypeRSA:     {2048, 3072, 4096, 8192},
+	KeyTypeEC:      {224, 256, 384, 521},
+	KeyTypeEd25519: {},
+}
+
+// VaultAuthConfig selects how cert-monitor logs in to Vault. The approle
+// method uses roleId, secretId and loginPath of the vault section.
+type VaultAuthConfig struct {
+	Method    string `yaml:"method"`
+	Namespace string `yaml:"namespace"`
+	Path      string `yaml:"path"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"`
+	Role      string `yaml:"role"`
+	JWTFile   string `yaml:"jwtFile"`
+	CertFile  string `yaml:"certFile"`
+	KeyFile   string `yaml:"keyFile"`
+}
+
+type VaultTLSConfig struct {
+	CACert     string `yaml:"caCert"`
+	ClientCert string `yaml:"clientCert"`
+	ClientKey  string `yaml:"clientKey"`
+	ServerName string `yaml:"serverName"`
+	MinVersion string `yaml:"minVersion"`
+	// InsecureSkipVerify disables the verification of the Vault
+	// certificate. Only meant for development.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
 type VaultConfig struct {
-	RoleId    string `yaml:"roleId"`
-	SecretId  string `yaml:"secretId"`
-	BaseUrl   string `yaml:"baseUrl"`
-	LoginPath string `yaml:"loginPath"`
+	RoleId   string `yaml:"roleId"`
+	SecretId string `yaml:"secretId"`
+	BaseUrl  string `yaml:"baseUrl"`
+	// BaseUrls lists the addresses of the nodes of a Vault cluster, in
+	// place of BaseUrl.
+	BaseUrls  []string         `yaml:"baseUrls"`
+	LoginPath string           `yaml:"loginPath"`
+	CertPath  string           `yaml:"certPath"`
+	SignPath  string           `yaml:"signPath"`
+	Namespace string           `yaml:"namespace"`
+	Auth      VaultAuthConfig  `yaml:"auth"`
+	TLS       VaultTLSConfig   `yaml:"tls"`
+	Timeout   time.Duration    `yaml:"timeout"`
+	Retry     VaultRetryConfig `yaml:"retry"`
+}
+
+// VaultRetryConfig is the retry policy of the Vault requests. Unset fields
+// keep the defaults of the vault package.
+type VaultRetryConfig struct {
+	MaxAttempts          int           `yaml:"maxAttempts"`
+	BaseBackoff          time.Duration `yaml:"baseBackoff"`
+	MaxBackoff           time.Duration `yaml:"maxBackoff"`
+	Jitter               float64       `yaml:"jitter"`
+	RetryableStatusCodes []int         `yaml:"retryableStatusCodes"`
+}
+
+// Addresses returns the base URLs of the Vault nodes.
+func (v VaultConfig) Addresses() []string {
+	if len(v.BaseUrls) > 0 {
+		return v.BaseUrls
+	}
+	return []string{v.BaseUrl}
+}
+
+func (r VaultRetryConfig) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("vault.retry.maxAttempts cannot be negative")
+	}
+	if r.BaseBackoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("vault.retry.baseBackoff and vault.retry.maxBackoff cannot be negative")
+	}
+	if r.MaxBackoff != 0 && r.BaseBackoff > r.MaxBackoff {
+		return fmt.Errorf("vault.retry.baseBackoff cannot be greater than vault.retry.maxBackoff")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("vault.retry.jitter must be between 0 and 1")
+	}
+	for _, code := range r.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("vault.retry.retryableStatusCodes %v is not an HTTP status code", code)
+		}
+	}
+	return nil
+}
+
+// CertVaultConfig overrides the Vault namespace and PKI role of a
+// certificate. certPath replaces the main one, while pkiMount and role
+// only replace a part of it.
+type CertVaultConfig struct {
+	Namespace string `yaml:"namespace"`
 	CertPath  string `yaml:"certPath"`
+	SignPath  string `yaml:"signPath"`
+	PkiMount  string `yaml:"pkiMount"`
+	Role      string `yaml:"role"`
+}
+
+func (t VaultTLSConfig) validate() error {
+	switch t.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("vault.tls.minVersion %v is invalid. Valid values are: 1.0, 1.1, 1.2, 1.3", t.MinVersion)
+	}
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return fmt.Errorf("vault.tls.clientCert and vault.tls.clientKey must be set together")
+	}
+	return nil
+}
+
+func (a VaultAuthConfig) validate() error {
+	switch a.Method {
+	case "", AuthMethodAppRole, AuthMethodToken:
+	case AuthMethodKubernetes:
+		if a.Role == "" {
+			return fmt.Errorf("vault.auth.role is required by the %v method", a.Method)
+		}
+	case AuthMethodCert:
+		if a.CertFile == "" || a.KeyFile == "" {
+			return fmt.Errorf("vault.auth.certFile and vault.auth.keyFile are required by the %v method", a.Method)
+		}
+	default:
+		return fmt.Errorf("vault.auth.method %v is invalid. Valid values are: %v, %v, %v, %v", a.Method, AuthMethodAppRole, AuthMethodToken, AuthMethodKubernetes, AuthMethodCert)
+	}
+	return nil
+}
+
+type MetricsConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+// FailureBackoffConfig sets how soon a certificate that failed to renew is
+// tried again: after base, doubled at each new failure up to max, and
+// never later than the check interval.
+type FailureBackoffConfig struct {
+	Base time.Duration `yaml:"base"`
+	Max  time.Duration `yaml:"max"`
 }
 
 type MainConfig struct {
-	Vault              VaultConfig   `yaml:"vault"`
-	IncludePaths       []string      `yaml:"includePaths"`
-	DownloadedCertPath string        `yaml:"downloadedCertPath"`
-	CheckInterval      time.Duration `yaml:"checkInterval"`
+	Vault              VaultConfig          `yaml:"vault"`
+	IncludePaths       []string             `yaml:"includePaths"`
+	DownloadedCertPath string               `yaml:"downloadedCertPath"`
+	CheckInterval      time.Duration        `yaml:"checkInterval"`
+	ArchiveRetention   int                  `yaml:"archiveRetention"`
+	Metrics            MetricsConfig        `yaml:"metrics"`
+	FailureBackoff     FailureBackoffConfig `yaml:"failureBackoff"`
+	// Watch reloads the certificate configurations as soon as a file
+	// matching IncludePaths changes (Linux only).
+	Watch bool `yaml:"watch"`
+	// Concurrency is the number of certificates renewed at the same time.
+	Concurrency int `yaml:"concurrency"`
+	// RenewJitter is the window before the renewal time over which the
+	// renewals are spread, so hosts sharing a configuration do not renew
+	// at the same time.
+	RenewJitter time.Duration `yaml:"renewJitter"`
 }
 
 type CertConfigOutput struct {
+	Type         string      `yaml:"type"`
+	Name         string      `yaml:"name"`
+	Perm         os.FileMode `yaml:"perm"`
+	Items        []string    `yaml:"items"`
+	User         string      `yaml:"user"`
+	Group        string      `yaml:"group"`
+	FriendlyName string      `yaml:"friendlyName"`
+	PasswordFile string      `yaml:"passwordFile"`
+	PasswordEnv  string      `yaml:"passwordEnv"`
+}
+
+// Percentage is a YAML percentage such as 33%.
+type Percentage float64
+
+func (p *Percentage) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(s, "%") {
+		return fmt.Errorf("%v is not a percentage", s)
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "%")), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%v is not a percentage", s)
+	}
+	*p = Percentage(value)
+	return nil
+}
+
+// Fraction returns the percentage as a fraction of 1.
+func (p Percentage) Fraction() float64 {
+	return float64(p) / 100
+}
+
+func (p Percentage) String() string {
+	return strconv.FormatFloat(float64(p), 'f', -1, 64) + "%"
+}
+
+// CertConfigOutputs is the list of files rendered from a single issued
+// certificate. The legacy single output format (a mapping with a file and
+// items keys) is still accepted.
+type CertConfigOutputs []CertConfigOutput
+
+type legacyCertConfigOutput struct {
 	File  CertConfigFile `yaml:"file"`
 	Items []string       `yaml:"items"`
 }
@@ -44,23 +279,112 @@ type CertConfigFile struct {
 	Perm os.FileMode `yaml:"perm"`
 }
 
+func (o *CertConfigOutputs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if _, ok := raw.([]interface{}); ok {
+		var outputs []CertConfigOutput
+		if err := unmarshal(&outputs); err != nil {
+			return err
+		}
+		*o = outputs
+		return nil
+	}
+
+	var legacy legacyCertConfigOutput
+	if err := unmarshal(&legacy); err != nil {
+		return err
+	}
+	*o = CertConfigOutputs{{
+		Type:  legacy.File.Type,
+		Name:  legacy.File.Name,
+		Perm:  legacy.File.Perm,
+		Items: legacy.Items,
+	}}
+	return nil
+}
+
+type CertConfigHooks struct {
+	PreDeploy  []string      `yaml:"preDeploy"`
+	PostDeploy []string      `yaml:"postDeploy"`
+	OnFailure  []string      `yaml:"onFailure"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
 type CertConfig struct {
-	CommonName     string           `yaml:"commonName"`
-	AlternateNames []string         `yaml:"alternateNames"`
-	ReloadCommand  string           `yaml:"reloadCommand"`
-	User           string           `yaml:"user"`
-	Group          string           `yaml:"group"`
-	TTL            time.Duration    `yaml:"ttl"`
-	RenewTTL       time.Duration    `yaml:"renewTtl"`
-	Output         CertConfigOutput `yaml:"output"`
-	MainConfig     *MainConfig
+	CommonName        string          `yaml:"commonName"`
+	AlternateNames    []string        `yaml:"alternateNames"`
+	IPSans            []string        `yaml:"ipSans"`
+	URISans           []string        `yaml:"uriSans"`
+	OtherSans         []string        `yaml:"otherSans"`
+	ExcludeCNFromSans bool            `yaml:"excludeCnFromSans"`
+	ReloadCommand     string          `yaml:"reloadCommand"`
+	ReloadTimeout     time.Duration   `yaml:"reloadTimeout"`
+	Hooks             CertConfigHooks `yaml:"hooks"`
+	Vault             CertVaultConfig `yaml:"vault"`
+	User              string          `yaml:"user"`
+	Group             string          `yaml:"group"`
+	TTL               time.Duration   `yaml:"ttl"`
+	RenewTTL          time.Duration   `yaml:"renewTtl"`
+	// RenewBefore is the part of the lifetime of the issued certificate
+	// before NotAfter during which it is renewed, used instead of
+	// RenewTTL.
+	RenewBefore      Percentage        `yaml:"renewBefore"`
+	KeyGeneration    string            `yaml:"keyGeneration"`
+	KeyType          string            `yaml:"keyType"`
+	KeyBits          int               `yaml:"keyBits"`
+	PrivateKeyFormat string            `yaml:"privateKeyFormat"`
+	Format           string            `yaml:"format"`
+	Output           CertConfigOutputs `yaml:"output"`
+	MainConfig       *MainConfig
 }
 
 func (c CertConfig) GroupId() (string, error) {
-	if c.Group != "" {
-		group, err := user.LookupGroup(c.Group)
+	return lookupGroupId(c.Group)
+}
+
+func (c CertConfig) UserId() (string, error) {
+	return lookupUserId(c.User)
+}
+
+func (o CertConfigOutput) GroupId() (string, error) {
+	return lookupGroupId(o.Group)
+}
+
+func (o CertConfigOutput) UserId() (string, error) {
+	return lookupUserId(o.User)
+}
+
+// Password returns the keystore password of the output, read from
+// passwordFile or from the passwordEnv environment variable.
+func (o CertConfigOutput) Password() (string, error) {
+	if o.PasswordFile != "" {
+		content, err := ioutil.ReadFile(o.PasswordFile)
 		if err != nil {
-			return "", fmt.Errorf("Error looking up for group %v: %v", c.Group, err)
+			return "", fmt.Errorf("Error reading password file %v: %v", o.PasswordFile, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	if o.PasswordEnv != "" {
+		password, ok := os.LookupEnv(o.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("Error: environment variable %v is not set", o.PasswordEnv)
+		}
+		return password, nil
+	}
+
+	return "", fmt.Errorf("Error: output %v requires passwordFile or passwordEnv", o.Name)
+}
+
+func lookupGroupId(name string) (string, error) {
+	if name != "" {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			return "", fmt.Errorf("Error looking up for group %v: %v", name, err)
 		}
 
 		return group.Gid, nil
@@ -74,12 +398,12 @@ func (c CertConfig) GroupId() (string, error) {
 	return group.Gid, nil
 }
 
-func (c CertConfig) UserId() (string, error) {
+func lookupUserId(name string) (string, error) {
 
-	if c.User != "" {
-		user, err := user.Lookup(c.User)
+	if name != "" {
+		user, err := user.Lookup(name)
 		if err != nil {
-			return "", fmt.Errorf("Error looking up user %v: %v", c.User, err)
+			return "", fmt.Errorf("Error looking up user %v: %v", name, err)
 		}
 
 		return user.Uid, nil
@@ -104,10 +428,174 @@ func (c CertConfig) Validate() error {
 
 	check(c.validateCommonName)
 	check(c.validateTTL)
+	check(c.validateKeyGeneration)
+	check(c.validateKeyType)
+	check(c.validateOutputs)
+	check(c.validateVault)
+	check(c.validateSans)
+	check(c.validateFormat)
+	check(c.validateTimeouts)
 
 	return err
 }
 
+// validateTimeouts rejects negative timeouts, which would kill the reload
+// command and the hooks as soon as they start.
+func (c CertConfig) validateTimeouts() error {
+	if c.ReloadTimeout < 0 {
+		return fmt.Errorf("reloadTimeout cannot be negative")
+	}
+	if c.Hooks.Timeout < 0 {
+		return fmt.Errorf("hooks.timeout cannot be negative")
+	}
+	return nil
+}
+
+func (c CertConfig) validateKeyGeneration() error {
+	switch c.KeyGeneration {
+	case "", KeyGenerationVault, KeyGenerationLocal:
+		return nil
+	default:
+		return fmt.Errorf("keyGeneration %v is invalid. Valid values are: %v, %v", c.KeyGeneration, KeyGenerationVault, KeyGenerationLocal)
+	}
+}
+
+func (c CertConfig) validateKeyType() error {
+	if c.KeyType == "" {
+		if c.KeyBits != 0 {
+			return fmt.Errorf("keyBits cannot be set without keyType")
+		}
+		return nil
+	}
+
+	bits, ok := validKeyBits[c.KeyType]
+	if !ok {
+		return fmt.Errorf("keyType %v is invalid. Valid values are: %v, %v, %v", c.KeyType, KeyTypeRSA, KeyTypeEC, KeyTypeEd25519)
+	}
+
+	if c.KeyBits == 0 {
+		return nil
+	}
+	for _, v := range bits {
+		if c.KeyBits == v {
+			return nil
+		}
+	}
+
+	if len(bits) == 0 {
+		return fmt.Errorf("keyBits cannot be set for keyType %v", c.KeyType)
+	}
+	return fmt.Errorf("keyBits %v is invalid for keyType %v. Valid values are: %v", c.KeyBits, c.KeyType, bits)
+}
+
+func (c CertConfig) validateOutputs() error {
+	names := map[string]bool{}
+
+	for i, o := range c.Output {
+		if o.Name == "" {
+			return fmt.Errorf("output[%d].name is not set", i)
+		}
+		if o.Type == "" {
+			return fmt.Errorf("output[%d].type is not set", i)
+		}
+		if o.PasswordFile != "" && o.PasswordEnv != "" {
+			return fmt.Errorf("output[%d] cannot set both passwordFile and passwordEnv", i)
+		}
+		if names[o.Name] {
+			return fmt.Errorf("output[%d].name %v is used more than once", i, o.Name)
+		}
+		names[o.Name] = true
+	}
+	return nil
+}
+
+func (c CertConfig) validateVault() error {
+	if c.Vault.CertPath != "" && (c.Vault.PkiMount != "" || c.Vault.Role != "") {
+		return fmt.Errorf("vault.certPath cannot be set with vault.pkiMount or vault.role")
+	}
+	if c.Vault.SignPath != "" && c.Vault.CertPath == "" {
+		return fmt.Errorf("vault.signPath requires vault.certPath")
+	}
+	return nil
+}
+
+func (c CertConfig) validateSans() error {
+	for _, ip := range c.IPSans {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("ipSans %v is not a valid IP address", ip)
+		}
+	}
+	// Vault takes the SANs as comma separated lists
+	for _, uri := range c.URISans {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme == "" {
+			return fmt.Errorf("uriSans %v is not a valid URI", uri)
+		}
+		if strings.Contains(uri, ",") {
+			return fmt.Errorf("uriSans %v cannot contain a comma", uri)
+		}
+	}
+	for _, other := range c.OtherSans {
+		// <oid>;<type>:<value>
+		parts := strings.SplitN(other, ";", 2)
+		if len(parts) != 2 || !validOID(parts[0]) || !strings.Contains(parts[1], ":") {
+			return fmt.Errorf("otherSans %v is invalid. Expected format is <oid>;<type>:<value>", other)
+		}
+		if strings.Contains(other, ",") {
+			return fmt.Errorf("otherSans %v cannot contain a comma", other)
+		}
+	}
+	return nil
+}
+
+func validOID(oid string) bool {
+	arcs := strings.Split(oid, ".")
+	if len(arcs) < 2 {
+		return false
+	}
+	for _, arc := range arcs {
+		if _, err := strconv.ParseUint(arc, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (c CertConfig) validateFormat() error {
+	switch c.Format {
+	case "", FormatPEM, FormatPEMBundle, FormatDER:
+	default:
+		return fmt.Errorf("format %v is invalid. Valid values are: %v, %v, %v", c.Format, FormatPEM, FormatPEMBundle, FormatDER)
+	}
+
+	switch c.PrivateKeyFormat {
+	case "", PrivateKeyFormatDER, PrivateKeyFormatPKCS8:
+	default:
+		return fmt.Errorf("privateKeyFormat %v is invalid. Valid values are: %v, %v", c.PrivateKeyFormat, PrivateKeyFormatDER, PrivateKeyFormatPKCS8)
+	}
+	if c.PrivateKeyFormat != "" && c.LocalKeyGeneration() {
+		return fmt.Errorf("privateKeyFormat cannot be set with keyGeneration %v", KeyGenerationLocal)
+	}
+	return nil
+}
+
+// applyOutputDefaults makes each output inherit the certificate user and
+// group unless it defines its own.
+func (c *CertConfig) applyOutputDefaults() {
+	for i := range c.Output {
+		if c.Output[i].User == "" {
+			c.Output[i].User = c.User
+		}
+		if c.Output[i].Group == "" {
+			c.Output[i].Group = c.Group
+		}
+	}
+}
+
+func (c CertConfig) LocalKeyGeneration() bool {
+	return c.KeyGeneration == KeyGenerationLocal
+}
+
 func (c CertConfig) validateCommonName() error {
 	if c.CommonName == "" {
 		return fmt.Errorf("commonName is not set")
@@ -116,8 +604,18 @@ func (c CertConfig) validateCommonName() error {
 }
 
 func (c CertConfig) validateTTL() error {
+	if c.RenewBefore != 0 {
+		if c.RenewTTL != 0 {
+			return fmt.Errorf("renewTtl and renewBefore cannot be set together")
+		}
+		if !(c.RenewBefore > 0 && c.RenewBefore < 100) {
+			return fmt.Errorf("renewBefore %v must be between 0%% and 100%%", c.RenewBefore)
+		}
+		return nil
+	}
+
 	if c.RenewTTL == 0 {
-		return fmt.Errorf("renewTtl is not set")
+		return fmt.Errorf("renewTtl or renewBefore is not set")
 	}
 
 	if c.TTL == 0 {
@@ -140,10 +638,83 @@ func LoadMainConfig(configPath string) (*MainConfig, error) {
 	if err := yaml.UnmarshalStrict(content, &mainConfig); err != nil {
 		return nil, fmt.Errorf("Error parsing YAML config file %v: %v", configPath, err)
 	}
+	if mainConfig.ArchiveRetention < 0 {
+		return nil, fmt.Errorf("Error in config file %v: archiveRetention cannot be negative", configPath)
+	}
+	if err := mainConfig.Vault.Auth.validate(); err != nil {
+		return nil, fmt.Errorf("Error in config file %v: %v", configPath, err)
+	}
+	if err := mainConfig.Vault.TLS.validate(); err != nil {
+		return nil, fmt.Errorf("Error in config file %v: %v", configPath, err)
+	}
+	if mainConfig.Vault.Timeout < 0 {
+		return nil, fmt.Errorf("Error in config file %v: vault.timeout cannot be negative", configPath)
+	}
+	if mainConfig.Vault.BaseUrl != "" && len(mainConfig.Vault.BaseUrls) > 0 {
+		return nil, fmt.Errorf("Error in config file %v: vault.baseUrl and vault.baseUrls cannot be set together", configPath)
+	}
+	if err := mainConfig.Vault.Retry.validate(); err != nil {
+		return nil, fmt.Errorf("Error in config file %v: %v", configPath, err)
+	}
+	if mainConfig.Concurrency < 0 {
+		return nil, fmt.Errorf("Error in config file %v: concurrency cannot be negative", configPath)
+	}
+	if mainConfig.FailureBackoff.Base < 0 || mainConfig.FailureBackoff.Max < 0 {
+		return nil, fmt.Errorf("Error in config file %v: failureBackoff.base and failureBackoff.max cannot be negative", configPath)
+	}
+	if mainConfig.RenewJitter < 0 {
+		return nil, fmt.Errorf("Error in config file %v: renewJitter cannot be negative", configPath)
+	}
 
 	return &mainConfig, nil
 }
 
+// Retention returns the number of certificate versions kept in the archive.
+func (m MainConfig) Retention() int {
+	if m.ArchiveRetention == 0 {
+		return defaultArchiveRetention
+	}
+	return m.ArchiveRetention
+}
+
+// Workers returns the number of certificates renewed at the same time, one
+// when concurrency is not set.
+func (m MainConfig) Workers() int {
+	if m.Concurrency < 1 {
+		return 1
+	}
+	return m.Concurrency
+}
+
+// Interval returns the interval between two scans of the certificate
+// configurations.
+func (m MainConfig) Interval() time.Duration {
+	if m.CheckInterval <= 0 {
+		return defaultCheckInterval
+	}
+	return m.CheckInterval
+}
+
+// FailureBackoffLimits returns the first and the longest wait before a
+// certificate that failed to renew is tried again. The longest wait is
+// capped by the check interval.
+func (m MainConfig) FailureBackoffLimits() (time.Duration, time.Duration) {
+	base, max := m.FailureBackoff.Base, m.FailureBackoff.Max
+	if base == 0 {
+		base = defaultFailureBackoffBase
+	}
+	if max == 0 {
+		max = defaultFailureBackoffMax
+	}
+	if max > m.Interval() {
+		max = m.Interval()
+	}
+	if base > max {
+		base = max
+	}
+	return base, max
+}
+
 func (m MainConfig) ResolveConfigDirs() ([]string, error) {
 	var errorString string
 	var dirs []string
@@ -173,6 +744,7 @@ func (m MainConfig) LoadCertConfig(file string) (CertConfig, error) {
 	if err := yaml.UnmarshalStrict(content, &certConfig); err != nil {
 		return certConfig, fmt.Errorf("Error parsing YAML content for file '%s': %v", file, err)
 	}
+	certConfig.applyOutputDefaults()
 	if err := certConfig.Validate(); err != nil {
 		return certConfig, fmt.Errorf("Error validating certificate configuration '%s': %v", file, err)
 	}
@@ -187,20 +759,121 @@ func (c CertConfig) IsExpired() bool {
 		return true
 	}
 
-	cutoffTime := cert.NotAfter.Add(-c.RenewTTL)
-
-	if time.Now().After(cutoffTime) {
+	if time.Now().After(c.RenewAfter(cert)) {
 		return true
 	}
 
 	return false
 }
 
+// RenewAfter is the time after which the certificate is renewed, computed
+// from the lifetime of the issued certificate and moved earlier by the
+// jitter of the host. renewTtl is scaled down when the certificate is
+// shorter than ttl so the renewal window never covers the whole lifetime.
+func (c CertConfig) RenewAfter(cert *x509.Certificate) time.Time {
+	return c.renewPoint(cert).Add(-c.RenewJitter(cert))
+}
+
+// renewPoint is the renewal time before the jitter is applied.
+func (c CertConfig) renewPoint(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+
+	if c.RenewBefore != 0 {
+		return cert.NotAfter.Add(-time.Duration(float64(lifetime) * c.RenewBefore.Fraction()))
+	}
+	if c.ShortenedTTL(cert) {
+		return cert.NotAfter.Add(-time.Duration(float64(lifetime) * float64(c.RenewTTL) / float64(c.TTL)))
+	}
+	return cert.NotAfter.Add(-c.RenewTTL)
+}
+
+// RenewJitter returns how much earlier than its renewal time the
+// certificate is renewed by this host. It is derived from the hostname and
+// the common name, within renewJitter and at most half of the time between
+// NotBefore and the renewal time.
+func (c CertConfig) RenewJitter(cert *x509.Certificate) time.Duration {
+	if c.MainConfig == nil || c.MainConfig.RenewJitter <= 0 {
+		return 0
+	}
+
+	window := c.MainConfig.RenewJitter
+	if limit := c.renewPoint(cert).Sub(cert.NotBefore) / 2; window > limit {
+		window = limit
+	}
+	return jitter(jitterSeed(), c.CommonName, window)
+}
+
+// jitterSeed identifies the host in the renewal jitter, so each host gets
+// its own renewal time for a certificate and keeps it across restarts.
+func jitterSeed() string {
+	hostSeed.Do(func() {
+		hostSeed.value = lookupJitterSeed(os.Hostname, machineIDFiles)
+	})
+	return hostSeed.value
+}
+
+// lookupJitterSeed returns the hostname, else the first machine ID found.
+func lookupJitterSeed(hostname func() (string, error), machineIDFiles []string) string {
+	name, err := hostname()
+	if err == nil && name != "" {
+		return name
+	}
+
+	for _, f := range machineIDFiles {
+		if content, err := ioutil.ReadFile(f); err == nil {
+			if id := strings.TrimSpace(string(content)); id != "" {
+				return id
+			}
+		}
+	}
+
+	log.Printf("Warning: unable to identify the host for the renewal jitter (hostname %q: %v), the renewals are not spread", name, err)
+	return ""
+}
+
+// jitter returns a duration in [0, window) that only depends on host and
+// commonName.
+func jitter(host, commonName string, window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write([]byte(commonName))
+	return time.Duration(h.Sum64() % uint64(window))
+}
+
+// ShortenedTTL reports whether the certificate was issued with a shorter
+// lifetime than ttl, usually because of the max_ttl of the Vault role.
+func (c CertConfig) ShortenedTTL(cert *x509.Certificate) bool {
+	return c.TTL != 0 && cert.NotAfter.Sub(cert.NotBefore) < c.TTL-shortenedTTLTolerance
+}
+
+// ArchivePath is the directory holding every downloaded version of the
+// certificate, one numbered sub directory per version.
+func (c CertConfig) ArchivePath() string {
+	return path.Join(c.MainConfig.DownloadedCertPath, archiveDirName, c.CommonName)
+}
+
+// LivePath is the symlink pointing to the archived version currently
+// deployed.
+func (c CertConfig) LivePath() string {
+	return path.Join(c.MainConfig.DownloadedCertPath, liveDirName, c.CommonName)
+}
+
 func (c CertConfig) LoadCachedCertificate() (*x509.Certificate, error) {
-	certFile := path.Join(c.MainConfig.DownloadedCertPath, c.CommonName, certFileName)
+	certFile := path.Join(c.LivePath(), certFileName)
+	if _, err := os.Lstat(c.LivePath()); os.IsNotExist(err) {
+		// cache layout used before the archive was introduced
+		certFile = path.Join(c.MainConfig.DownloadedCertPath, c.CommonName, certFileName)
+	}
 
-	if _, err := os.Stat(c.Output.File.Name); err != nil {
-		return nil, err
+	for _, o := range c.Output {
+		if _, err := os.Stat(o.Name); err != nil {
+			return nil, err
+		}
 	}
 
 	if _, err := os.Stat(certFile); err != nil {
@@ -213,8 +886,8 @@ func (c CertConfig) LoadCachedCertificate() (*x509.Certificate, error) {
 	}
 
 	block, _ := pem.Decode([]byte(content))
-	if err != nil {
-		return nil, err
+	if block == nil {
+		return nil, fmt.Errorf("Error: no PEM data found in %v", certFile)
 	}
 
 	cert, err := x509.ParseCertificate(block.Bytes)
@@ -1,8 +1,16 @@
 package config
 
 import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	yaml "gopkg.in/yaml.v2"
 )
 
 type testTtl struct {
@@ -64,3 +72,508 @@ func TestValidate(t *testing.T) {
 	}
 
 }
+
+func TestValidateTimeouts(t *testing.T) {
+	cert := CertConfig{ReloadTimeout: 30 * time.Second, Hooks: CertConfigHooks{Timeout: time.Minute}}
+	if err := cert.validateTimeouts(); err != nil {
+		t.Errorf("Timeouts should be valid: %v", err)
+	}
+
+	cert.ReloadTimeout = -time.Second
+	if err := cert.validateTimeouts(); err == nil {
+		t.Errorf("Negative reloadTimeout should be invalid")
+	}
+
+	cert.ReloadTimeout = 0
+	cert.Hooks.Timeout = -time.Second
+	if err := cert.validateTimeouts(); err == nil {
+		t.Errorf("Negative hooks.timeout should be invalid")
+	}
+}
+
+func TestRenewBefore(t *testing.T) {
+	var certConfig CertConfig
+	if err := yaml.Unmarshal([]byte("renewBefore: 33%"), &certConfig); err != nil {
+		t.Fatal(err)
+	}
+	if certConfig.RenewBefore != 33 || certConfig.RenewBefore.String() != "33%" {
+		t.Errorf("Unexpected renewBefore %v", certConfig.RenewBefore)
+	}
+	if err := yaml.Unmarshal([]byte("renewBefore: 33"), &certConfig); err == nil {
+		t.Errorf("renewBefore without %% should be invalid")
+	}
+	for _, value := range []string{"NaN%", "Inf%", "-Inf%"} {
+		if err := yaml.Unmarshal([]byte("renewBefore: "+value), &certConfig); err == nil {
+			t.Errorf("renewBefore %v should be invalid", value)
+		}
+	}
+
+	valid := []CertConfig{
+		{RenewBefore: 33},
+		{RenewBefore: 50, TTL: time.Hour},
+	}
+	for _, c := range valid {
+		if err := c.validateTTL(); err != nil {
+			t.Errorf("%+v should be valid: %v", c, err)
+		}
+	}
+	invalid := []CertConfig{
+		{RenewBefore: 100},
+		{RenewBefore: -5},
+		{RenewBefore: Percentage(math.NaN())},
+		{RenewBefore: 33, RenewTTL: time.Hour, TTL: 2 * time.Hour},
+	}
+	for _, c := range invalid {
+		if err := c.validateTTL(); err == nil {
+			t.Errorf("%+v should be invalid", c)
+		}
+	}
+}
+
+func TestRenewAfter(t *testing.T) {
+	notBefore := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := func(lifetime time.Duration) *x509.Certificate {
+		return &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(lifetime)}
+	}
+
+	tests := []struct {
+		config    CertConfig
+		lifetime  time.Duration
+		window    time.Duration
+		shortened bool
+	}{
+		{CertConfig{TTL: 72 * time.Hour, RenewTTL: 24 * time.Hour}, 72*time.Hour + 30*time.Second, 24 * time.Hour, false},
+		{CertConfig{TTL: 72 * time.Hour, RenewBefore: 25}, 100 * time.Hour, 25 * time.Hour, false},
+		// clamped by the max_ttl of the role
+		{CertConfig{TTL: 72 * time.Hour, RenewTTL: 48 * time.Hour}, 24 * time.Hour, 16 * time.Hour, true},
+		{CertConfig{TTL: 72 * time.Hour, RenewBefore: 50}, 24 * time.Hour, 12 * time.Hour, true},
+		{CertConfig{RenewBefore: 10}, 24 * time.Hour, 144 * time.Minute, false},
+	}
+	for _, test := range tests {
+		c := cert(test.lifetime)
+		if window := c.NotAfter.Sub(test.config.RenewAfter(c)); window != test.window {
+			t.Errorf("%+v with a lifetime of %v: expected a renewal window of %v, got %v", test.config, test.lifetime, test.window, window)
+		}
+		if shortened := test.config.ShortenedTTL(c); shortened != test.shortened {
+			t.Errorf("%+v with a lifetime of %v: expected shortened %v", test.config, test.lifetime, test.shortened)
+		}
+	}
+}
+
+func TestRenewJitter(t *testing.T) {
+	notBefore := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(72 * time.Hour)}
+	certConfig := CertConfig{CommonName: "test.domain.tld", TTL: 72 * time.Hour, RenewTTL: 24 * time.Hour}
+
+	if certConfig.RenewJitter(cert) != 0 {
+		t.Errorf("No jitter expected without a main configuration")
+	}
+	certConfig.MainConfig = &MainConfig{}
+	if certConfig.RenewJitter(cert) != 0 {
+		t.Errorf("No jitter expected when renewJitter is not set")
+	}
+
+	certConfig.MainConfig.RenewJitter = 6 * time.Hour
+	j := certConfig.RenewJitter(cert)
+	if j < 0 || j >= 6*time.Hour {
+		t.Errorf("Jitter %v is outside of the window", j)
+	}
+	if j != certConfig.RenewJitter(cert) {
+		t.Errorf("Jitter should be deterministic")
+	}
+	if renewAfter := certConfig.RenewAfter(cert); !renewAfter.Equal(cert.NotAfter.Add(-24*time.Hour - j)) {
+		t.Errorf("Jitter not applied to the renewal time %v", renewAfter)
+	}
+
+	spread := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		spread[jitter(fmt.Sprintf("host%d", i), certConfig.CommonName, 6*time.Hour)] = true
+	}
+	if len(spread) < 15 {
+		t.Errorf("Jitter of different hosts should differ, got %d distinct values", len(spread))
+	}
+
+	// never more than half of the time before the renewal
+	certConfig.MainConfig.RenewJitter = 1000 * time.Hour
+	if j := certConfig.RenewJitter(cert); j >= 24*time.Hour {
+		t.Errorf("Jitter %v should be capped to 24h", j)
+	}
+}
+
+func TestLookupJitterSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	machineID := filepath.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(machineID, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{filepath.Join(dir, "missing"), machineID}
+
+	hostname := func() (string, error) { return "web01", nil }
+	if seed := lookupJitterSeed(hostname, files); seed != "web01" {
+		t.Errorf("Expected the hostname, got %q", seed)
+	}
+
+	hostname = func() (string, error) { return "", fmt.Errorf("no hostname") }
+	if seed := lookupJitterSeed(hostname, files); seed != "0123456789abcdef" {
+		t.Errorf("Expected the machine ID, got %q", seed)
+	}
+	if seed := lookupJitterSeed(hostname, files[:1]); seed != "" {
+		t.Errorf("Expected no seed, got %q", seed)
+	}
+}
+
+func TestValidateKeyGeneration(t *testing.T) {
+	for _, v := range []string{"", KeyGenerationVault, KeyGenerationLocal} {
+		cert := CertConfig{KeyGeneration: v}
+		if err := cert.validateKeyGeneration(); err != nil {
+			t.Errorf("keyGeneration %q should be valid: %v", v, err)
+		}
+	}
+
+	cert := CertConfig{KeyGeneration: "remote"}
+	if err := cert.validateKeyGeneration(); err == nil {
+		t.Errorf("keyGeneration validation must fail for unknown values")
+	}
+}
+
+func TestValidateKeyType(t *testing.T) {
+	valid := []CertConfig{
+		{},
+		{KeyType: KeyTypeRSA},
+		{KeyType: KeyTypeRSA, KeyBits: 2048},
+		{KeyType: KeyTypeRSA, KeyBits: 4096},
+		{KeyType: KeyTypeEC, KeyBits: 256},
+		{KeyType: KeyTypeEC, KeyBits: 384},
+		{KeyType: KeyTypeEd25519},
+	}
+	for _, cert := range valid {
+		if err := cert.validateKeyType(); err != nil {
+			t.Errorf("keyType %q keyBits %d should be valid: %v", cert.KeyType, cert.KeyBits, err)
+		}
+	}
+
+	invalid := []CertConfig{
+		{KeyBits: 2048},
+		{KeyType: "dsa"},
+		{KeyType: KeyTypeRSA, KeyBits: 1024},
+		{KeyType: KeyTypeRSA, KeyBits: 256},
+		{KeyType: KeyTypeEC, KeyBits: 2048},
+		{KeyType: KeyTypeEd25519, KeyBits: 256},
+	}
+	for _, cert := range invalid {
+		if err := cert.validateKeyType(); err == nil {
+			t.Errorf("keyType %q keyBits %d should be invalid", cert.KeyType, cert.KeyBits)
+		}
+	}
+}
+
+func TestValidateVaultAuth(t *testing.T) {
+	valid := []VaultAuthConfig{
+		{},
+		{Method: AuthMethodAppRole},
+		{Method: AuthMethodToken},
+		{Method: AuthMethodToken, TokenFile: "/run/vault/token"},
+		{Method: AuthMethodKubernetes, Role: "cert-monitor"},
+		{Method: AuthMethodCert, CertFile: "/etc/ssl/client.pem", KeyFile: "/etc/ssl/client.key"},
+	}
+	for _, auth := range valid {
+		if err := auth.validate(); err != nil {
+			t.Errorf("vault.auth %+v should be valid: %v", auth, err)
+		}
+	}
+
+	invalid := []VaultAuthConfig{
+		{Method: "ldap"},
+		{Method: AuthMethodKubernetes},
+		{Method: AuthMethodCert, CertFile: "/etc/ssl/client.pem"},
+	}
+	for _, auth := range invalid {
+		if err := auth.validate(); err == nil {
+			t.Errorf("vault.auth %+v should be invalid", auth)
+		}
+	}
+}
+
+func TestValidateVaultTLS(t *testing.T) {
+	valid := []VaultTLSConfig{
+		{},
+		{CACert: "/etc/ssl/vault-ca.pem", MinVersion: "1.2"},
+		{ClientCert: "/etc/ssl/client.pem", ClientKey: "/etc/ssl/client.key"},
+	}
+	for _, tls := range valid {
+		if err := tls.validate(); err != nil {
+			t.Errorf("vault.tls %+v should be valid: %v", tls, err)
+		}
+	}
+
+	invalid := []VaultTLSConfig{
+		{MinVersion: "1.4"},
+		{MinVersion: "tls12"},
+		{ClientCert: "/etc/ssl/client.pem"},
+		{ClientKey: "/etc/ssl/client.key"},
+	}
+	for _, tls := range invalid {
+		if err := tls.validate(); err == nil {
+			t.Errorf("vault.tls %+v should be invalid", tls)
+		}
+	}
+}
+
+func TestVaultAddresses(t *testing.T) {
+	single := VaultConfig{BaseUrl: "https://vault:8200"}
+	if addresses := single.Addresses(); len(addresses) != 1 || addresses[0] != "https://vault:8200" {
+		t.Errorf("Unexpected addresses %v", addresses)
+	}
+
+	cluster := VaultConfig{BaseUrls: []string{"https://vault1:8200", "https://vault2:8200"}}
+	if addresses := cluster.Addresses(); len(addresses) != 2 || addresses[1] != "https://vault2:8200" {
+		t.Errorf("Unexpected addresses %v", addresses)
+	}
+}
+
+func TestValidateVaultRetry(t *testing.T) {
+	valid := []VaultRetryConfig{
+		{},
+		{MaxAttempts: 5, BaseBackoff: time.Second, MaxBackoff: time.Minute, Jitter: 0.5},
+		{RetryableStatusCodes: []int{429, 503}},
+	}
+	for _, retry := range valid {
+		if err := retry.validate(); err != nil {
+			t.Errorf("vault.retry %+v should be valid: %v", retry, err)
+		}
+	}
+
+	invalid := []VaultRetryConfig{
+		{MaxAttempts: -1},
+		{BaseBackoff: -time.Second},
+		{BaseBackoff: time.Minute, MaxBackoff: time.Second},
+		{Jitter: 1.5},
+		{RetryableStatusCodes: []int{5030}},
+	}
+	for _, retry := range invalid {
+		if err := retry.validate(); err == nil {
+			t.Errorf("vault.retry %+v should be invalid", retry)
+		}
+	}
+}
+
+func TestFailureBackoffLimits(t *testing.T) {
+	tests := []struct {
+		config    MainConfig
+		base, max time.Duration
+	}{
+		{MainConfig{CheckInterval: time.Hour}, time.Minute, 30 * time.Minute},
+		{MainConfig{CheckInterval: 10 * time.Minute}, time.Minute, 10 * time.Minute},
+		{MainConfig{CheckInterval: 30 * time.Second}, 30 * time.Second, 30 * time.Second},
+		{MainConfig{CheckInterval: time.Hour, FailureBackoff: FailureBackoffConfig{Base: 5 * time.Second, Max: 2 * time.Hour}}, 5 * time.Second, time.Hour},
+	}
+	for _, test := range tests {
+		base, max := test.config.FailureBackoffLimits()
+		if base != test.base || max != test.max {
+			t.Errorf("failure backoff of %+v: expected %v/%v, got %v/%v", test.config.FailureBackoff, test.base, test.max, base, max)
+		}
+	}
+}
+
+func TestValidateVault(t *testing.T) {
+	valid := []CertVaultConfig{
+		{},
+		{Namespace: "team-a", Role: "databases"},
+		{PkiMount: "pki-internal", Role: "clients"},
+		{CertPath: "/v1/pki/issue/webservers", SignPath: "/v1/pki/sign/webservers"},
+	}
+	for _, vault := range valid {
+		if err := (CertConfig{Vault: vault}).validateVault(); err != nil {
+			t.Errorf("vault %+v should be valid: %v", vault, err)
+		}
+	}
+
+	invalid := []CertVaultConfig{
+		{CertPath: "/v1/pki/issue/webservers", Role: "databases"},
+		{CertPath: "/v1/pki/issue/webservers", PkiMount: "pki-internal"},
+		{SignPath: "/v1/pki/sign/webservers"},
+	}
+	for _, vault := range invalid {
+		if err := (CertConfig{Vault: vault}).validateVault(); err == nil {
+			t.Errorf("vault %+v should be invalid", vault)
+		}
+	}
+}
+
+func TestValidateSans(t *testing.T) {
+	valid := []CertConfig{
+		{},
+		{IPSans: []string{"10.0.0.1", "fd00::1"}},
+		{URISans: []string{"spiffe://domain.tld/ns/web/sa/nginx", "urn:uuid:6e8bc430-9c3a-11d9-9669-0800200c9a66"}},
+		{OtherSans: []string{"1.3.6.1.4.1.311.20.2.3;UTF8:web@domain.tld"}},
+	}
+	for _, cert := range valid {
+		if err := cert.validateSans(); err != nil {
+			t.Errorf("SANs %+v should be valid: %v", cert, err)
+		}
+	}
+
+	invalid := []CertConfig{
+		{IPSans: []string{"10.0.0.256"}},
+		{IPSans: []string{"host.domain.tld"}},
+		{URISans: []string{"/relative/path"}},
+		{URISans: []string{"spiffe://domain.tld/%zz"}},
+		{OtherSans: []string{"web@domain.tld"}},
+		{OtherSans: []string{"1.3.6.x;UTF8:web@domain.tld"}},
+		{OtherSans: []string{"1.3.6.1;web@domain.tld"}},
+		{OtherSans: []string{"2.5.4.3;UTF8:Doe, John"}},
+		{URISans: []string{"https://domain.tld/a,b"}},
+	}
+	for _, cert := range invalid {
+		if err := cert.validateSans(); err == nil {
+			t.Errorf("SANs %+v should be invalid", cert)
+		}
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	valid := []CertConfig{
+		{},
+		{Format: FormatPEM},
+		{Format: FormatPEMBundle, PrivateKeyFormat: PrivateKeyFormatDER},
+		{Format: FormatDER, PrivateKeyFormat: PrivateKeyFormatPKCS8},
+	}
+	for _, cert := range valid {
+		if err := cert.validateFormat(); err != nil {
+			t.Errorf("format %q privateKeyFormat %q should be valid: %v", cert.Format, cert.PrivateKeyFormat, err)
+		}
+	}
+
+	invalid := []CertConfig{
+		{Format: "p7b"},
+		{PrivateKeyFormat: "pkcs1"},
+		{PrivateKeyFormat: PrivateKeyFormatPKCS8, KeyGeneration: KeyGenerationLocal},
+	}
+	for _, cert := range invalid {
+		if err := cert.validateFormat(); err == nil {
+			t.Errorf("format %q privateKeyFormat %q should be invalid", cert.Format, cert.PrivateKeyFormat)
+		}
+	}
+}
+
+func TestUnmarshalOutputs(t *testing.T) {
+	content := `
+commonName: test.domain.tld
+user: nobody
+output:
+- type: bundle
+  name: /etc/nginx/test.crt
+  perm: 0644
+  items: [certificate, chain]
+- type: bundle
+  name: /etc/nginx/test.key
+  perm: 0600
+  group: nginx
+  items: [privateKey]
+`
+	cert := CertConfig{}
+	if err := yaml.UnmarshalStrict([]byte(content), &cert); err != nil {
+		t.Fatalf("Error parsing outputs: %v", err)
+	}
+	cert.applyOutputDefaults()
+
+	if len(cert.Output) != 2 {
+		t.Fatalf("Expected 2 outputs, got %d", len(cert.Output))
+	}
+	if cert.Output[1].Name != "/etc/nginx/test.key" || cert.Output[1].Perm != 0600 {
+		t.Errorf("Unexpected second output %+v", cert.Output[1])
+	}
+	if cert.Output[0].User != "nobody" || cert.Output[1].User != "nobody" {
+		t.Errorf("Outputs should inherit the certificate user")
+	}
+	if cert.Output[1].Group != "nginx" {
+		t.Errorf("Output group should not be overridden, got %v", cert.Output[1].Group)
+	}
+}
+
+func TestUnmarshalLegacyOutput(t *testing.T) {
+	content := `
+commonName: test.domain.tld
+output:
+  file:
+    type: bundle
+    name: /etc/httpd/test.pem
+    perm: 0600
+  items:
+    - certificate
+    - privateKey
+`
+	cert := CertConfig{}
+	if err := yaml.UnmarshalStrict([]byte(content), &cert); err != nil {
+		t.Fatalf("Error parsing legacy output: %v", err)
+	}
+
+	if len(cert.Output) != 1 {
+		t.Fatalf("Expected 1 output, got %d", len(cert.Output))
+	}
+	o := cert.Output[0]
+	if o.Type != "bundle" || o.Name != "/etc/httpd/test.pem" || o.Perm != 0600 || len(o.Items) != 2 {
+		t.Errorf("Unexpected legacy output conversion %+v", o)
+	}
+}
+
+func TestValidateOutputs(t *testing.T) {
+	cert := CertConfig{Output: CertConfigOutputs{
+		{Type: "bundle", Name: "/tmp/a.pem"},
+		{Type: "bundle", Name: "/tmp/b.pem"},
+	}}
+	if err := cert.validateOutputs(); err != nil {
+		t.Errorf("Outputs should be valid: %v", err)
+	}
+
+	cert.Output = append(cert.Output, CertConfigOutput{Type: "bundle", Name: "/tmp/a.pem"})
+	if err := cert.validateOutputs(); err == nil {
+		t.Errorf("Duplicate output names must fail validation")
+	}
+
+	cert.Output = CertConfigOutputs{{Type: "bundle"}}
+	if err := cert.validateOutputs(); err == nil {
+		t.Errorf("Output without name must fail validation")
+	}
+}
+
+func TestOutputPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o := CertConfigOutput{PasswordFile: passwordFile}
+	if password, err := o.Password(); err != nil || password != "secret" {
+		t.Errorf("Expected password 'secret' from file, got %q (%v)", password, err)
+	}
+
+	os.Setenv("CERT_MONITOR_TEST_PASSWORD", "env-secret")
+	defer os.Unsetenv("CERT_MONITOR_TEST_PASSWORD")
+
+	o = CertConfigOutput{PasswordEnv: "CERT_MONITOR_TEST_PASSWORD"}
+	if password, err := o.Password(); err != nil || password != "env-secret" {
+		t.Errorf("Expected password 'env-secret' from environment, got %q (%v)", password, err)
+	}
+
+	o = CertConfigOutput{PasswordEnv: "CERT_MONITOR_TEST_UNSET"}
+	if _, err := o.Password(); err == nil {
+		t.Errorf("Unset environment variable must be an error")
+	}
+
+	o = CertConfigOutput{}
+	if _, err := o.Password(); err == nil {
+		t.Errorf("Output without password source must be an error")
+	}
+}
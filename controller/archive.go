@@ -0,0 +1,225 @@
+package controller
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vdesjardins/cert-monitor/config"
+	"github.com/vdesjardins/cert-monitor/vault"
+)
+
+// archiveVersions returns the versions stored in the certificate archive
+// in ascending order.
+func archiveVersions(certConfig config.CertConfig) ([]int, error) {
+	entries, err := ioutil.ReadDir(certConfig.ArchivePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading archive directory %s: %v", certConfig.ArchivePath(), err)
+	}
+
+	var versions []int
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		v, err := strconv.Atoi(e.Name())
+		if err != nil || v <= 0 {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+
+	return versions, nil
+}
+
+func archiveVersionPath(certConfig config.CertConfig, version int) string {
+	return filepath.Join(certConfig.ArchivePath(), strconv.Itoa(version))
+}
+
+// liveVersion returns the archived version the live symlink points to, or
+// 0 when no version is live yet.
+func liveVersion(certConfig config.CertConfig) (int, error) {
+	target, err := os.Readlink(certConfig.LivePath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error reading live symlink %s: %v", certConfig.LivePath(), err)
+	}
+
+	version, err := strconv.Atoi(filepath.Base(target))
+	if err != nil {
+		return 0, fmt.Errorf("Error: live symlink %s points to an invalid version %s", certConfig.LivePath(), target)
+	}
+	return version, nil
+}
+
+// writeArchiveVersion saves the downloaded certificate, issuing CA, private
+// key and chain in a new archive version directory.
+func writeArchiveVersion(certConfig config.CertConfig, version int, cert vault.CertResponse) error {
+	dir := archiveVersionPath(certConfig, version)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Error: can't create directory %s: %v", dir, err)
+	}
+
+	chain := ""
+	for _, v := range cert.Data.Chain {
+		chain += v + "\n"
+	}
+
+	files := []struct {
+		name    string
+		content string
+		perm    os.FileMode
+	}{
+		{certFileName, cert.Data.Certificate, 0644},
+		{issuingCAFileName, cert.Data.IssuingCa, 0644},
+		{privateFileName, cert.Data.PrivateKey, 0600},
+		{chainFileName, chain, 0644},
+	}
+
+	for _, f := range files {
+		name := filepath.Join(dir, f.name)
+		log.Printf("Saving certificate file %s\n", name)
+		if err := writeFileAtomic(name, []byte(f.content), f.perm, -1, -1); err != nil {
+			return fmt.Errorf("Error saving downloaded certificate information in cache file %v: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// loadArchiveVersion rebuilds the certificate data of an archived version.
+func loadArchiveVersion(certConfig config.CertConfig, version int) (vault.CertResponse, error) {
+	var cert vault.CertResponse
+	dir := archiveVersionPath(certConfig, version)
+
+	read := func(name string) (string, error) {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", fmt.Errorf("Error reading archived file: %v", err)
+		}
+		return string(content), nil
+	}
+
+	var err error
+	if cert.Data.Certificate, err = read(certFileName); err != nil {
+		return cert, err
+	}
+	if cert.Data.IssuingCa, err = read(issuingCAFileName); err != nil {
+		return cert, err
+	}
+	if cert.Data.PrivateKey, err = read(privateFileName); err != nil {
+		return cert, err
+	}
+	chain, err := read(chainFileName)
+	if err != nil {
+		return cert, err
+	}
+
+	rest := []byte(chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert.Data.Chain = append(cert.Data.Chain, strings.TrimSpace(string(pem.EncodeToMemory(block))))
+	}
+
+	return cert, nil
+}
+
+// switchLiveVersion atomically repoints the live symlink to an archived
+// version.
+func switchLiveVersion(certConfig config.CertConfig, version int) error {
+	live := certConfig.LivePath()
+	dir := filepath.Dir(live)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Error: can't create directory %s: %v", dir, err)
+	}
+
+	target, err := filepath.Rel(dir, archiveVersionPath(certConfig, version))
+	if err != nil {
+		return fmt.Errorf("Error computing live symlink target: %v", err)
+	}
+
+	tmp := filepath.Join(dir, "."+filepath.Base(live)+".tmp")
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("Error creating symlink %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, live); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Error switching live symlink %s: %v", live, err)
+	}
+
+	log.Printf("Live certificate %s now points to version %d\n", live, version)
+	return syncDir(dir)
+}
+
+// pruneArchive removes the oldest versions beyond the retention count,
+// never removing the live version.
+func pruneArchive(certConfig config.CertConfig, retention int) error {
+	versions, err := archiveVersions(certConfig)
+	if err != nil {
+		return err
+	}
+	live, err := liveVersion(certConfig)
+	if err != nil {
+		return err
+	}
+
+	for len(versions) > retention {
+		v := versions[0]
+		versions = versions[1:]
+		if v == live {
+			continue
+		}
+		log.Printf("Removing archived version %d of %s\n", v, certConfig.CommonName)
+		if err := os.RemoveAll(archiveVersionPath(certConfig, v)); err != nil {
+			return fmt.Errorf("Error pruning archive: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// previousVersion returns the newest archived version older than the live
+// one.
+func previousVersion(certConfig config.CertConfig) (int, error) {
+	live, err := liveVersion(certConfig)
+	if err != nil {
+		return 0, err
+	}
+	if live == 0 {
+		return 0, fmt.Errorf("Error: no live version for %s", certConfig.CommonName)
+	}
+
+	versions, err := archiveVersions(certConfig)
+	if err != nil {
+		return 0, err
+	}
+
+	previous := 0
+	for _, v := range versions {
+		if v < live {
+			previous = v
+		}
+	}
+	if previous == 0 {
+		return 0, fmt.Errorf("Error: no archived version older than %d for %s", live, certConfig.CommonName)
+	}
+
+	return previous, nil
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vdesjardins/cert-monitor/config"
+)
+
+// failureBackoff delays the next renewal attempt of the certificates that
+// failed to renew, keyed by certificate configuration file. The wait
+// doubles at each consecutive failure.
+type failureBackoff struct {
+	mu      sync.Mutex
+	entries map[string]backoffEntry
+}
+
+type backoffEntry struct {
+	failures  int
+	nextRetry time.Time
+}
+
+// renewalBackoff is shared by the checks of ExecLoop.
+var renewalBackoff = &failureBackoff{}
+
+// ready reports whether the certificate can be renewed at now.
+func (b *failureBackoff) ready(file string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[file]
+	return !ok || !now.Before(entry.nextRetry)
+}
+
+// failed records a failed renewal and returns the time of the next attempt.
+func (b *failureBackoff) failed(file string, cfg *config.MainConfig, now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.entries == nil {
+		b.entries = map[string]backoffEntry{}
+	}
+
+	base, max := cfg.FailureBackoffLimits()
+	entry := b.entries[file]
+	entry.failures++
+
+	wait := base
+	for i := 1; i < entry.failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	entry.nextRetry = now.Add(wait)
+	b.entries[file] = entry
+
+	return entry.nextRetry
+}
+
+// succeeded forgets the failures of the certificate.
+func (b *failureBackoff) succeeded(file string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, file)
+}
+
+// nextRetry returns the earliest retry after now of the failing
+// certificates, false when there is none.
+func (b *failureBackoff) nextRetry(now time.Time) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var next time.Time
+	for _, entry := range b.entries {
+		if !entry.nextRetry.After(now) {
+			continue
+		}
+		if next.IsZero() || entry.nextRetry.Before(next) {
+			next = entry.nextRetry
+		}
+	}
+	return next, !next.IsZero()
+}
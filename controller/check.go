@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Nagios plugin exit codes.
+const (
+	CheckOK       = 0
+	CheckWarning  = 1
+	CheckCritical = 2
+	CheckUnknown  = 3
+)
+
+var checkStateNames = map[int]string{
+	CheckOK:       "OK",
+	CheckWarning:  "WARNING",
+	CheckCritical: "CRITICAL",
+	CheckUnknown:  "UNKNOWN",
+}
+
+// checkSeverity orders the states from the least to the most severe when
+// several certificates are checked.
+var checkSeverity = map[int]int{
+	CheckOK:       0,
+	CheckUnknown:  1,
+	CheckWarning:  2,
+	CheckCritical: 3,
+}
+
+// Check prints a Nagios plugin summary of the certificates and returns the
+// plugin exit code. A certificate is critical when it expires within
+// critical, is expired or is missing, and warning when it expires within
+// warning. An invalid configuration is unknown. When certConfigPath is set
+// only this configuration is checked.
+func Check(configPath, certConfigPath string, warning, critical time.Duration) int {
+	if critical > warning {
+		fmt.Printf("CERT-MONITOR UNKNOWN - critical threshold %v is greater than warning threshold %v\n", critical, warning)
+		return CheckUnknown
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Printf("%v", err)
+		fmt.Printf("CERT-MONITOR UNKNOWN - %v\n", err)
+		return CheckUnknown
+	}
+
+	files := []string{certConfigPath}
+	if certConfigPath == "" {
+		files, err = cfg.ResolveConfigDirs()
+		if err != nil {
+			log.Printf("%v", err)
+			fmt.Printf("CERT-MONITOR UNKNOWN - %v\n", err)
+			return CheckUnknown
+		}
+	}
+
+	now := time.Now()
+	code, output := checkStatus(loadStatus(cfg, files, now), warning, critical, now)
+	fmt.Println(output)
+
+	return code
+}
+
+// checkStatus evaluates the certificates against the thresholds and
+// returns the exit code and the plugin output line.
+func checkStatus(statuses []certificateStatus, warning, critical time.Duration, now time.Time) (int, string) {
+	code := CheckOK
+	counts := map[int]int{}
+	var problems, perfdata []string
+
+	for _, s := range statuses {
+		name := s.CommonName
+		if name == "" {
+			name = filepath.Base(s.Config)
+		}
+
+		var certCode int
+		var problem string
+		switch s.State {
+		case stateConfigError:
+			certCode, problem = CheckUnknown, fmt.Sprintf("%s invalid configuration", name)
+		case stateMissing:
+			certCode, problem = CheckCritical, fmt.Sprintf("%s missing", name)
+		default:
+			remaining := s.notAfter.Sub(now)
+			switch {
+			case remaining <= 0:
+				certCode, problem = CheckCritical, fmt.Sprintf("%s expired", name)
+			case remaining <= critical:
+				certCode, problem = CheckCritical, fmt.Sprintf("%s expires in %d days", name, *s.DaysRemaining)
+			case remaining <= warning:
+				certCode, problem = CheckWarning, fmt.Sprintf("%s expires in %d days", name, *s.DaysRemaining)
+			}
+			perfdata = append(perfdata, fmt.Sprintf("'%s'=%d;%d;%d",
+				strings.Replace(name, "'", "''", -1), *s.DaysRemaining, daysRemaining(warning), daysRemaining(critical)))
+		}
+
+		counts[certCode]++
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+		if checkSeverity[certCode] > checkSeverity[code] {
+			code = certCode
+		}
+	}
+
+	var summary []string
+	for _, c := range []int{CheckCritical, CheckWarning, CheckUnknown, CheckOK} {
+		if counts[c] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[c], strings.ToLower(checkStateNames[c])))
+		}
+	}
+	if len(summary) == 0 {
+		summary = append(summary, "no certificate")
+	}
+
+	output := fmt.Sprintf("CERT-MONITOR %s - %s", checkStateNames[code], strings.Join(summary, ", "))
+	if len(problems) > 0 {
+		output += ": " + strings.Join(problems, "; ")
+	}
+	if len(perfdata) > 0 {
+		output += " | " + strings.Join(perfdata, " ")
+	}
+
+	return code, output
+}
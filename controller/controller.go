@@ -1,23 +1,21 @@
 package controller
 
 import (
-	"bytes"
+	"context"
+	"crypto/x509"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
-	"text/tabwriter"
+	"syscall"
 	"time"
 
 	"github.com/vdesjardins/cert-monitor/config"
+	"github.com/vdesjardins/cert-monitor/keystore"
 	"github.com/vdesjardins/cert-monitor/vault"
 )
 
@@ -29,13 +27,16 @@ const (
 )
 
 func ExecOnce(configPath string, noReload bool, certConfigPath string) error {
+	ctx, cancel := signalContext()
+	defer cancel()
+
 	cfg, err := loadConfig(configPath)
 	if err != nil {
 		return err
 	}
 	log.Printf("Main configuration '%s' loaded sucessefully.\n", configPath)
 
-	err = execute(cfg, noReload, true, certConfigPath)
+	err = execute(ctx, cfg, noReload, true, certConfigPath)
 	if err != nil {
 		return err
 	}
@@ -50,81 +51,155 @@ func ExecLoop(configPath string, noReload bool) {
 	go func() {
 		defer wg.Done()
 
+		ctx, cancel := signalContext()
+		defer cancel()
+
 		cfg, err := loadConfig(configPath)
 		if err != nil {
 			log.Fatalf("aborting! %v", err)
 		}
 		log.Printf("Main configuration '%s' loaded sucessefully.\n", configPath)
 
-		execute(cfg, noReload, false, "")
+		if cfg.Metrics.Listen != "" {
+			if err := serveMetrics(cfg.Metrics.Listen); err != nil {
+				log.Fatalf("aborting! %v", err)
+			}
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 
-		log.Printf("Check interval set to %v", cfg.CheckInterval)
-		ticker := time.Tick(cfg.CheckInterval)
+		watcher := newConfigWatcher()
+		defer watcher.stop()
+		watcher.update(cfg)
 
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt)
-		signal.Notify(sig, os.Kill)
+		log.Printf("Check interval set to %v", cfg.Interval())
 
 		for {
+			execute(ctx, cfg, noReload, false, "")
+			if ctx.Err() != nil {
+				log.Printf("Exiting...\n")
+				return
+			}
+
+			// sleep until the next certificate is due, rescanning the
+			// configurations at least every check interval
+			files, _ := cfg.ResolveConfigDirs()
+			next := nextCheck(cfg, files, time.Now())
+			log.Printf("Next check at %v", next.Format(time.RFC3339))
+
+			timer := time.NewTimer(time.Until(next))
 			select {
-			case <-sig:
+			case <-ctx.Done():
+				timer.Stop()
 				log.Printf("Exiting...\n")
 				return
-			case <-ticker:
-				cfg, err := loadConfig(configPath)
-				if err != nil {
-					log.Printf("%v\n", err)
-					continue
+			case <-hup:
+				log.Printf("SIGHUP received, reloading configuration")
+			case <-watcher.changes:
+				// let the editor finish writing before reading the files
+				time.Sleep(watchSettleDelay)
+				select {
+				case <-watcher.changes:
+				default:
 				}
-				log.Printf("Main configuration '%s' loaded sucessefully.\n", configPath)
-				execute(cfg, noReload, false, "")
+				log.Printf("Certificate configuration change detected")
+			case <-timer.C:
 			}
+			timer.Stop()
 
+			newCfg, err := loadConfig(configPath)
+			if err != nil {
+				log.Printf("%v\n", err)
+				continue
+			}
+			log.Printf("Main configuration '%s' loaded sucessefully.\n", configPath)
+			cfg = newCfg
+			watcher.update(cfg)
 		}
 	}()
 
 	wg.Wait()
 }
 
-func PrintStatus(configPath string) error {
+// Rollback repoints the live version of a certificate to the previous
+// archived version, renders its outputs again and reloads the service.
+func Rollback(configPath string, noReload bool, certConfigPath string) error {
+	// a first signal lets the rollback and its reload complete
+	_, cancel := signalContext()
+	defer cancel()
+
 	cfg, err := loadConfig(configPath)
 	if err != nil {
 		log.Printf("%v", err)
 		return err
 	}
 
-	files, err := cfg.ResolveConfigDirs()
+	certConfig, err := cfg.LoadCertConfig(certConfigPath)
 	if err != nil {
 		log.Printf("%v", err)
 		return err
 	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	version, err := previousVersion(certConfig)
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
 
-	fmt.Fprintln(w, "Configuration\tTTL\tRenewTTL\tNot Before\tRenew After\tNot After")
-	format := "%v\t%v\t%v\t%v\t%v\t%v\n"
+	leaf, err := rollbackCertificate(certConfig, version)
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
 
-	for _, v := range files {
-		c, err := cfg.LoadCertConfig(v)
-		if err != nil {
-			fmt.Fprintf(w, format, v, "-", "-", "-", "-", "-")
-			continue
-		}
+	if noReload == false {
+		reloads := &reloadQueue{}
+		reloads.add(certConfig, newRenewedCertificate(certConfig, leaf))
+		return reloads.run()
+	}
 
-		cert, err := c.LoadCachedCertificate()
-		if err != nil {
-			fmt.Fprintf(w, format, v, c.TTL, c.RenewTTL, "-", "-", "-")
-			continue
-		}
-		fmt.Fprintf(w, format, v, c.TTL, c.RenewTTL,
-			cert.NotBefore.Format(time.RFC3339),
-			cert.NotAfter.Add(-c.RenewTTL).Format(time.RFC3339),
-			cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func rollbackCertificate(certConfig config.CertConfig, version int) (*x509.Certificate, error) {
+	log.Printf("Rolling back %s to version %d\n", certConfig.CommonName, version)
+
+	cert, err := loadArchiveVersion(certConfig, version)
+	if err != nil {
+		return nil, err
 	}
 
-	w.Flush()
+	leaf, err := parseCertificate(cert.Data.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing archived certificate: %v", err)
+	}
 
-	return nil
+	if err := deployCertificate(certConfig, version, cert); err != nil {
+		return nil, fmt.Errorf("Error rolling back certificate: %v", err)
+	}
+
+	return leaf, nil
+}
+
+// signalContext returns a context cancelled by SIGINT or SIGTERM. A second
+// signal terminates the process.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("Received %v, stopping...\n", s)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+
+	return ctx, cancel
 }
 
 func loadConfig(configPath string) (*config.MainConfig, error) {
@@ -136,9 +211,9 @@ func loadConfig(configPath string) (*config.MainConfig, error) {
 	return cfg, nil
 }
 
-func execute(cfg *config.MainConfig, noReload bool, failOnError bool, certConfigPath string) error {
+func execute(ctx context.Context, cfg *config.MainConfig, noReload bool, failOnError bool, certConfigPath string) error {
 	if certConfigPath != "" {
-		return checkCertificatesAndRenew(cfg, []string{certConfigPath}, noReload, failOnError)
+		return checkCertificatesAndRenew(ctx, cfg, []string{certConfigPath}, noReload, failOnError)
 	}
 
 	files, err := cfg.ResolveConfigDirs()
@@ -149,151 +224,339 @@ func execute(cfg *config.MainConfig, noReload bool, failOnError bool, certConfig
 		}
 	}
 
-	return checkCertificatesAndRenew(cfg, files, noReload, failOnError)
+	return checkCertificatesAndRenew(ctx, cfg, files, noReload, failOnError)
 }
 
-func checkCertificatesAndRenew(cfg *config.MainConfig, files []string, noReload, failOnError bool) error {
-	vaultClient, err := initVaultClient(*cfg)
-	if err != nil {
-		log.Printf("%+v", err)
-		return err
-	}
-
-	servicesToRestart := map[string]bool{}
+// certResult is the outcome of the check of one certificate configuration.
+type certResult struct {
+	certConfig config.CertConfig
+	// cert is the deployed certificate, nil when none was deployed.
+	cert *x509.Certificate
+	err  error
+	// fatal is set when err prevented the renewal.
+	fatal bool
+}
 
-	for _, f := range files {
-		certConfig, err := cfg.LoadCertConfig(f)
-		if err != nil {
-			log.Println(err)
-			if failOnError == true {
-				return err
-			}
-			continue
+// archiveLocks serializes the renewals of a certificate archive.
+var archiveLocks = &keyedMutex{}
+
+// checkCertificatesAndRenew renews the certificates due for renewal, up to
+// cfg.Workers() at a time. The failures of a certificate do not affect the
+// others and the reload commands run once every certificate is processed,
+// in the order of files. When ctx is cancelled the remaining certificates
+// are skipped; a certificate being deployed is either fully deployed or
+// left untouched.
+func checkCertificatesAndRenew(ctx context.Context, cfg *config.MainConfig, files []string, noReload, failOnError bool) error {
+	reloads := &reloadQueue{}
+	var failures []string
+
+	results := make([]certResult, len(files))
+	runPool(cfg.Workers(), len(files), func(i int) bool {
+		if ctx.Err() != nil {
+			return false
 		}
-
-		if !certConfig.IsExpired() {
-			continue
+		results[i] = checkCertificate(ctx, cfg, files[i], failOnError)
+		return !(failOnError && results[i].fatal)
+	})
+	if ctx.Err() != nil {
+		log.Printf("Stopping, the remaining certificates are not checked")
+	}
+
+	var fatalErr error
+	for _, r := range results {
+		// the deployed certificates are reloaded even when another one
+		// aborts the check
+		if r.cert != nil && noReload == false {
+			reloads.add(r.certConfig, newRenewedCertificate(r.certConfig, r.cert))
 		}
-
-		log.Printf("Generating certificate for commonName %v alternateNames %v", certConfig.CommonName, certConfig.AlternateNames)
-		err = renewCertificate(certConfig, vaultClient)
-		if err != nil {
-			log.Println(err)
-			if failOnError == true {
-				return err
+		if r.fatal {
+			if failOnError == true && fatalErr == nil {
+				fatalErr = r.err
 			}
 			continue
 		}
-
-		if noReload == false {
-			servicesToRestart[certConfig.ReloadCommand] = true
+		if r.err != nil {
+			failures = append(failures, r.err.Error())
 		}
 	}
 
 	// restart services
-	for k, _ := range servicesToRestart {
-		restartService(k)
+	if err := reloads.run(); err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	if fatalErr != nil {
+		return fatalErr
 	}
 
+	lastCheck.Set(timestamp(time.Now()))
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%v", strings.Join(failures, "; "))
+	}
 	return nil
 }
 
-func renewCertificate(certConfig config.CertConfig, vaultClient *vault.Client) error {
-	certReq := initCertRequest(certConfig)
+// checkCertificate renews the certificate of the configuration file f
+// when it is due for renewal.
+func checkCertificate(ctx context.Context, cfg *config.MainConfig, f string, failOnError bool) certResult {
+	certConfig, err := cfg.LoadCertConfig(f)
+	if err != nil {
+		log.Println(err)
+		configErrors.Inc(f)
+		if failOnError == true {
+			return certResult{err: err, fatal: true}
+		}
+		previous, ok := lastValidCertConfig(cfg, f)
+		if !ok {
+			return certResult{err: err, fatal: true}
+		}
+		log.Printf("Keeping the last valid configuration of %v", f)
+		certConfig = previous
+	} else {
+		rememberCertConfig(f, certConfig)
+	}
+
+	if cached, err := certConfig.LoadCachedCertificate(); err == nil {
+		recordCertificate(f, certConfig, cached)
+	}
+
+	if !certConfig.IsExpired() {
+		renewalBackoff.succeeded(f)
+		return certResult{certConfig: certConfig}
+	}
 
-	cert, err := vaultClient.FetchNewCertificate(certReq)
+	if !renewalBackoff.ready(f, time.Now()) {
+		return certResult{certConfig: certConfig}
+	}
+
+	vaultClient, err := getVaultClient(certConfig)
+	if err != nil {
+		log.Println(err)
+		recordRenewal(f, certConfig, err)
+		renewalBackoff.failed(f, cfg, time.Now())
+		return certResult{certConfig: certConfig, err: err, fatal: true}
+	}
+
+	// configurations sharing a commonName share the archive and live
+	// directories, their versions must not be numbered concurrently
+	unlock := archiveLocks.lock(certConfig.ArchivePath())
+	log.Printf("Generating certificate for commonName %v alternateNames %v", certConfig.CommonName, certConfig.AlternateNames)
+	cert, err := renewCertificate(ctx, certConfig, vaultClient)
+	unlock()
+	if err != nil && cert == nil && ctx.Err() != nil {
+		// interrupted, not a failure of the certificate
+		log.Println(err)
+		return certResult{certConfig: certConfig, err: err}
+	}
+	recordRenewal(f, certConfig, err)
+	if cert != nil {
+		recordCertificate(f, certConfig, cert)
+	}
+	if err != nil && cert == nil {
+		log.Println(err)
+		next := renewalBackoff.failed(f, cfg, time.Now())
+		log.Printf("Retrying %v at %v", certConfig.CommonName, next.Format(time.RFC3339))
+		return certResult{certConfig: certConfig, err: err, fatal: true}
+	}
+	renewalBackoff.succeeded(f)
+	if err != nil {
+		// deployed, but a postDeploy hook failed
+		log.Println(err)
+	}
+
+	return certResult{certConfig: certConfig, cert: cert, err: err}
+}
+
+// renewCertificate fetches and deploys a new certificate, running the
+// certificate hooks around the deployment. The certificate is returned
+// with a non nil error when it was deployed but a postDeploy hook failed.
+func renewCertificate(ctx context.Context, certConfig config.CertConfig, vaultClient *vault.Client) (*x509.Certificate, error) {
+	leaf, err := fetchAndPersistCertificate(ctx, certConfig, vaultClient)
 	if err != nil {
-		return fmt.Errorf("Error fetching new certificate: %v", err)
+		runFailureHooks(ctx, certConfig, err)
+		return nil, err
 	}
 
-	if err := persistCertificate(certConfig, cert); err != nil {
-		return fmt.Errorf("Error saving new certificate: %v", err)
+	if err := runPostDeployHooks(ctx, certConfig, newRenewedCertificate(certConfig, leaf)); err != nil {
+		runFailureHooks(ctx, certConfig, err)
+		return leaf, err
 	}
 
-	return nil
+	return leaf, nil
+}
+
+func fetchAndPersistCertificate(ctx context.Context, certConfig config.CertConfig, vaultClient *vault.Client) (*x509.Certificate, error) {
+	var cert vault.CertResponse
+	var err error
+
+	if certConfig.LocalKeyGeneration() {
+		cert, err = signCertificate(ctx, certConfig, vaultClient)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		certReq := initCertRequest(certConfig)
+
+		cert, err = vaultClient.FetchNewCertificate(ctx, certReq)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching new certificate: %v", err)
+		}
+	}
+
+	cert, err = pemCertificate(certConfig.Format, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := parseCertificate(cert.Data.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing new certificate: %v", err)
+	}
+	if certConfig.ShortenedTTL(leaf) {
+		log.Printf("Warning: Vault issued %v for %v instead of the requested ttl %v, check the max_ttl of the role. Renewing after %v.",
+			certConfig.CommonName, leaf.NotAfter.Sub(leaf.NotBefore), certConfig.TTL, certConfig.RenewAfter(leaf).Format(time.RFC3339))
+	}
+
+	if err := persistCertificate(ctx, certConfig, cert); err != nil {
+		return nil, fmt.Errorf("Error saving new certificate: %v", err)
+	}
+
+	return leaf, nil
 }
 
-func initVaultClient(mainConfig config.MainConfig) (*vault.Client, error) {
-	baseUrl, err := url.Parse(mainConfig.Vault.BaseUrl)
+func signCertificate(ctx context.Context, certConfig config.CertConfig, vaultClient *vault.Client) (vault.CertResponse, error) {
+	var cert vault.CertResponse
+
+	key, keyPem, err := generatePrivateKey(certConfig)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse Vault base URL %v: %v", mainConfig.Vault.BaseUrl, err)
+		return cert, err
 	}
-	certPath, err := url.Parse(mainConfig.Vault.CertPath)
+
+	csr, err := createCSR(certConfig, key)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse Vault certificate URL path %v: %v", mainConfig.Vault.CertPath, err)
+		return cert, err
+	}
+
+	signReq := vault.SignRequest{
+		CertRequest: initCertRequest(certConfig),
+		CSR:         csr,
 	}
-	loginPath, err := url.Parse(mainConfig.Vault.LoginPath)
+
+	cert, err = vaultClient.SignCertificate(ctx, signReq)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse Vault login URL path %v: %v", mainConfig.Vault.LoginPath, err)
+		return cert, fmt.Errorf("Error signing new certificate: %v", err)
 	}
 
-	return &vault.Client{
-		BaseUrl:   *baseUrl,
-		CertPath:  *certPath,
-		LoginPath: *loginPath,
-		RoleId:    mainConfig.Vault.RoleId,
-		SecretId:  mainConfig.Vault.SecretId,
-	}, nil
+	// the private key never leaves this host; Vault only returns the
+	// signed certificate.
+	cert.Data.PrivateKey = strings.TrimSpace(keyPem)
+
+	return cert, nil
 }
+
 func initCertRequest(certConfig config.CertConfig) vault.CertRequest {
 	certRequest := vault.CertRequest{}
 
 	certRequest.CommonName = certConfig.CommonName
 	certRequest.AlternateNames = strings.Join(certConfig.AlternateNames, ",")
+	certRequest.IPSans = strings.Join(certConfig.IPSans, ",")
+	certRequest.URISans = strings.Join(certConfig.URISans, ",")
+	certRequest.OtherSans = strings.Join(certConfig.OtherSans, ",")
+	certRequest.ExcludeCNFromSans = certConfig.ExcludeCNFromSans
 	if certConfig.TTL != 0 {
 		certRequest.TTL = certConfig.TTL.String()
 	}
+	certRequest.KeyType = certConfig.KeyType
+	certRequest.KeyBits = certConfig.KeyBits
+	certRequest.PrivateKeyFormat = certConfig.PrivateKeyFormat
+	certRequest.Format = certConfig.Format
 
 	return certRequest
 }
 
-func persistCertificate(certConfig config.CertConfig, cert vault.CertResponse) error {
-	var err error
-
-	checkError := func(name string, content string, certConfig config.CertConfig, perm os.FileMode) {
-		if err != nil {
-			return
-		}
-		err = saveDownloadedFile(name, content, perm)
-		if err != nil {
-			err = fmt.Errorf("Error saving downloaded certificate information in cache file %v: %v", name, err)
-		}
+// persistCertificate archives and deploys a new certificate. A cancelled
+// ctx aborts it before the outputs are written, never during.
+func persistCertificate(ctx context.Context, certConfig config.CertConfig, cert vault.CertResponse) error {
+	versions, err := archiveVersions(certConfig)
+	if err != nil {
+		return err
+	}
+	version := 1
+	if len(versions) > 0 {
+		version = versions[len(versions)-1] + 1
 	}
 
-	certBaseDir := path.Join(certConfig.MainConfig.DownloadedCertPath, certConfig.CommonName)
+	if err := writeArchiveVersion(certConfig, version, cert); err != nil {
+		os.RemoveAll(archiveVersionPath(certConfig, version))
+		return err
+	}
 
-	checkError(path.Join(certBaseDir, certFileName), cert.Data.Certificate, certConfig, 0644)
-	checkError(path.Join(certBaseDir, issuingCAFileName), cert.Data.IssuingCa, certConfig, 0644)
-	checkError(path.Join(certBaseDir, privateFileName), cert.Data.PrivateKey, certConfig, 0600)
+	if err := runPreDeployHooks(ctx, certConfig, cert); err != nil {
+		os.RemoveAll(archiveVersionPath(certConfig, version))
+		return err
+	}
 
-	chain := ""
-	for _, v := range cert.Data.Chain {
-		chain += v + "\n"
+	if ctx.Err() != nil {
+		os.RemoveAll(archiveVersionPath(certConfig, version))
+		return fmt.Errorf("Error: deployment of %s interrupted: %v", certConfig.CommonName, ctx.Err())
 	}
-	checkError(path.Join(certBaseDir, chainFileName), chain, certConfig, 0644)
 
-	if err != nil {
+	if err := deployCertificate(certConfig, version, cert); err != nil {
+		os.RemoveAll(archiveVersionPath(certConfig, version))
 		return err
 	}
 
-	err = saveOutputFile(certConfig, cert)
-	if err != nil {
+	if err := pruneArchive(certConfig, certConfig.MainConfig.Retention()); err != nil {
+		log.Println(err)
+	}
+
+	return nil
+}
+
+// deployCertificate renders every output from an archived version and
+// switches the live symlink to it. On failure the previous outputs are
+// restored and live is left untouched.
+func deployCertificate(certConfig config.CertConfig, version int, cert vault.CertResponse) error {
+	tx := &fileTransaction{}
+
+	rollback := func(err error) error {
+		if rollbackErr := tx.rollback(); rollbackErr != nil {
+			log.Println(rollbackErr)
+		}
 		return err
 	}
+
+	for _, output := range certConfig.Output {
+		if err := saveOutputFile(tx, output, cert); err != nil {
+			return rollback(err)
+		}
+	}
+
+	if err := switchLiveVersion(certConfig, version); err != nil {
+		return rollback(err)
+	}
+
 	return nil
 }
 
-func saveOutputFile(certConfig config.CertConfig, cert vault.CertResponse) error {
-	switch certConfig.Output.File.Type {
+func saveOutputFile(tx *fileTransaction, output config.CertConfigOutput, cert vault.CertResponse) error {
+	switch output.Type {
 	case "bundle":
-		return saveBundleFile(certConfig, cert)
+		return saveBundleFile(tx, output, cert)
+	case "pkcs12":
+		return savePKCS12File(tx, output, cert)
+	case "jks":
+		return saveJKSFile(tx, output, cert)
+	case "jks-truststore":
+		return saveJKSTrustStoreFile(tx, output, cert)
 	default:
-		return fmt.Errorf("Error: ouput.file.type %s not supported. Can only be bundle\n", certConfig.Output.File.Type)
+		return fmt.Errorf("Error: output.type %s not supported. Valid values are: bundle, pkcs12, jks, jks-truststore\n", output.Type)
 	}
 }
 
-func saveBundleFile(certConfig config.CertConfig, cert vault.CertResponse) error {
-	log.Printf("Saving output file %s\n", certConfig.Output.File.Name)
+func saveBundleFile(tx *fileTransaction, output config.CertConfigOutput, cert vault.CertResponse) error {
+	log.Printf("Saving output file %s\n", output.Name)
 
 	var content string
 
@@ -302,11 +565,14 @@ func saveBundleFile(certConfig config.CertConfig, cert vault.CertResponse) error
 			content += str + "\n"
 		}
 	}
-	for _, v := range certConfig.Output.Items {
+	for _, v := range output.Items {
 		switch v {
 		case "certificate":
 			appendContent(cert.Data.Certificate)
 		case "privateKey":
+			if cert.Data.PrivateKey == "" {
+				return fmt.Errorf("Error: no private key available for output.items privateKey\n")
+			}
 			appendContent(cert.Data.PrivateKey)
 		case "issuingCa":
 			appendContent(cert.Data.IssuingCa)
@@ -319,66 +585,122 @@ func saveBundleFile(certConfig config.CertConfig, cert vault.CertResponse) error
 		}
 	}
 
-	path := filepath.Dir(certConfig.Output.File.Name)
-	if err := os.MkdirAll(path, certConfig.Output.File.Perm); err != nil {
-		return fmt.Errorf("Error: can't create directory %s: %v", path, err)
-	}
+	return writeOutputFile(tx, output, []byte(content))
+}
 
-	if err := ioutil.WriteFile(certConfig.Output.File.Name, []byte(content), certConfig.Output.File.Perm); err != nil {
-		return fmt.Errorf("Error: unable to write bundle file %s: %v", certConfig.Output.File.Name, err)
+func savePKCS12File(tx *fileTransaction, output config.CertConfigOutput, cert vault.CertResponse) error {
+	log.Printf("Saving output file %s\n", output.Name)
+
+	key, leaf, chain, err := parseKeyAndCertificates(cert)
+	if err != nil {
+		return fmt.Errorf("Error preparing pkcs12 file %s: %v", output.Name, err)
 	}
 
-	userId, err := certConfig.UserId()
+	password, err := output.Password()
 	if err != nil {
 		return err
 	}
-	groupId, err := certConfig.GroupId()
+
+	content, err := keystore.EncodePKCS12(key, leaf, chain, keystoreAlias(output, leaf), password)
 	if err != nil {
-		return err
+		return fmt.Errorf("Error encoding pkcs12 file %s: %v", output.Name, err)
 	}
 
-	uid, err := strconv.Atoi(userId)
+	return writeOutputFile(tx, output, content)
+}
+
+func saveJKSFile(tx *fileTransaction, output config.CertConfigOutput, cert vault.CertResponse) error {
+	log.Printf("Saving output file %s\n", output.Name)
+
+	key, leaf, chain, err := parseKeyAndCertificates(cert)
 	if err != nil {
-		return fmt.Errorf("Error: cannot convert %s to int:%v\n", userId, err)
+		return fmt.Errorf("Error preparing jks file %s: %v", output.Name, err)
 	}
-	gid, err := strconv.Atoi(groupId)
+
+	password, err := output.Password()
 	if err != nil {
-		return fmt.Errorf("Error: cannot convert %s to int:%v\n", groupId, err)
+		return err
 	}
 
-	if err := os.Chown(certConfig.Output.File.Name, uid, gid); err != nil {
-		return fmt.Errorf("Error: failed to change file ownership on %s to %d:%d:%v\n", certConfig.Output.File.Name, uid, gid, err)
+	content, err := keystore.EncodeJKS(key, leaf, chain, keystoreAlias(output, leaf), password)
+	if err != nil {
+		return fmt.Errorf("Error encoding jks file %s: %v", output.Name, err)
 	}
-	return nil
+
+	return writeOutputFile(tx, output, content)
 }
 
-func saveDownloadedFile(name string, content string, perm os.FileMode) error {
-	log.Printf("Saving certificate file %s\n", name)
+func saveJKSTrustStoreFile(tx *fileTransaction, output config.CertConfigOutput, cert vault.CertResponse) error {
+	log.Printf("Saving output file %s\n", output.Name)
 
-	path := filepath.Dir(name)
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return fmt.Errorf("Error: can't create directory %s: %v", path, err)
+	caCerts, err := parseCACertificates(cert)
+	if err != nil {
+		return fmt.Errorf("Error preparing jks-truststore file %s: %v", output.Name, err)
+	}
+	if len(caCerts) == 0 {
+		return fmt.Errorf("Error: no CA certificate available for jks-truststore file %s", output.Name)
+	}
+
+	password, err := output.Password()
+	if err != nil {
+		return err
 	}
 
-	if err := ioutil.WriteFile(name, []byte(content), perm); err != nil {
-		return fmt.Errorf("Error: unable to write file %s: %v\n", name, err)
+	var entries []keystore.TrustStoreEntry
+	aliases := map[string]bool{}
+	for i, c := range caCerts {
+		alias := strings.ToLower(c.Subject.CommonName)
+		if alias == "" || aliases[alias] {
+			alias = fmt.Sprintf("ca-%d", i)
+		}
+		aliases[alias] = true
+		entries = append(entries, keystore.TrustStoreEntry{Alias: alias, Certificate: c})
 	}
-	return nil
+
+	content, err := keystore.EncodeJKSTrustStore(entries, password)
+	if err != nil {
+		return fmt.Errorf("Error encoding jks-truststore file %s: %v", output.Name, err)
+	}
+
+	return writeOutputFile(tx, output, content)
+}
+
+// keystoreAlias returns the friendly name of the key entry, defaulting to
+// the certificate common name.
+func keystoreAlias(output config.CertConfigOutput, leaf *x509.Certificate) string {
+	if output.FriendlyName != "" {
+		return output.FriendlyName
+	}
+	return leaf.Subject.CommonName
 }
 
-func restartService(command string) {
-	if command == "" {
-		log.Printf("No reload command specified. Skipping.\n")
-		return
+func writeOutputFile(tx *fileTransaction, output config.CertConfigOutput, content []byte) error {
+	// directories need the search permission wherever the file is readable
+	path := filepath.Dir(output.Name)
+	if err := os.MkdirAll(path, output.Perm|(output.Perm&0444)>>2); err != nil {
+		return fmt.Errorf("Error: can't create directory %s: %v", path, err)
 	}
 
-	log.Printf("Executing command `%v'\n", command)
-	cmd := exec.Command("/bin/bash", "-c", command)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
+	userId, err := output.UserId()
+	if err != nil {
+		return err
+	}
+	groupId, err := output.GroupId()
 	if err != nil {
-		log.Printf("Error executing command. error: %v\n", err)
-		log.Printf("Output: %q\n", out.String())
+		return err
 	}
+
+	uid, err := strconv.Atoi(userId)
+	if err != nil {
+		return fmt.Errorf("Error: cannot convert %s to int:%v\n", userId, err)
+	}
+	gid, err := strconv.Atoi(groupId)
+	if err != nil {
+		return fmt.Errorf("Error: cannot convert %s to int:%v\n", groupId, err)
+	}
+
+	if err := tx.writeFile(output.Name, content, output.Perm, uid, gid); err != nil {
+		return fmt.Errorf("Error: unable to write %s file %s: %v", output.Type, output.Name, err)
+	}
+	return nil
 }
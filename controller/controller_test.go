@@ -0,0 +1,1365 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vdesjardins/cert-monitor/config"
+	"github.com/vdesjardins/cert-monitor/internal/pkcs12test"
+	"github.com/vdesjardins/cert-monitor/vault"
+)
+
+func loadTestCertificate(t *testing.T) vault.CertResponse {
+	var cert vault.CertResponse
+
+	content, err := ioutil.ReadFile(filepath.Join("..", "vault", "testdata", "new_cert.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &cert); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cert-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSavePKCS12File(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("CERT_MONITOR_TEST_P12_PASSWORD", "changeit")
+	defer os.Unsetenv("CERT_MONITOR_TEST_P12_PASSWORD")
+
+	output := config.CertConfigOutput{
+		Type:        "pkcs12",
+		Name:        filepath.Join(dir, "keystore.p12"),
+		Perm:        0600,
+		PasswordEnv: "CERT_MONITOR_TEST_P12_PASSWORD",
+	}
+
+	if err := saveOutputFile(&fileTransaction{}, output, cert); err != nil {
+		t.Fatalf("Error saving pkcs12 output: %v", err)
+	}
+
+	info, err := os.Stat(output.Name)
+	if err != nil {
+		t.Fatalf("pkcs12 file was not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected permissions 0600, got %v", info.Mode().Perm())
+	}
+	// the friendly name defaults to the common name of the certificate
+	checkPKCS12File(t, output.Name, "changeit", "s01-test-vince-test.web.capitale.qc.ca", cert)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	output.PasswordEnv = ""
+	output.PasswordFile = passwordFile
+	output.FriendlyName = "tomcat"
+	if err := saveOutputFile(&fileTransaction{}, output, cert); err != nil {
+		t.Fatalf("Error saving pkcs12 output: %v", err)
+	}
+	checkPKCS12File(t, output.Name, "from-file", "tomcat", cert)
+}
+
+// checkPKCS12File decodes a pkcs12 output and compares it to the issued
+// certificate.
+func checkPKCS12File(t *testing.T, name, password, friendlyName string, cert vault.CertResponse) {
+	key, leaf, chain, err := parseKeyAndCertificates(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedKey, decodedLeaf, decodedChain, decodedName, err := pkcs12test.Decode(content, password)
+	if err != nil {
+		t.Fatalf("Error decoding pkcs12 file with password %q: %v", password, err)
+	}
+
+	if decodedName != friendlyName {
+		t.Errorf("Expected friendly name %q, got %q", friendlyName, decodedName)
+	}
+	if !decodedLeaf.Equal(leaf) {
+		t.Errorf("pkcs12 certificate does not match the issued certificate")
+	}
+	if len(decodedChain) != len(chain) || len(chain) == 0 {
+		t.Fatalf("Expected %d CA certificates, got %d", len(chain), len(decodedChain))
+	}
+	for i := range chain {
+		if !decodedChain[i].Equal(chain[i]) {
+			t.Errorf("pkcs12 CA certificate %d does not match", i)
+		}
+	}
+	if !reflect.DeepEqual(decodedKey.(crypto.Signer).Public(), key.(crypto.Signer).Public()) {
+		t.Errorf("pkcs12 private key does not match the issued key")
+	}
+}
+
+func TestSavePKCS12FileErrors(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	output := config.CertConfigOutput{
+		Type: "pkcs12",
+		Name: filepath.Join(dir, "keystore.p12"),
+		Perm: 0600,
+	}
+	if err := saveOutputFile(&fileTransaction{}, output, cert); err == nil {
+		t.Errorf("pkcs12 output without password source must fail")
+	}
+
+	output.PasswordEnv = "CERT_MONITOR_TEST_P12_PASSWORD"
+	os.Setenv(output.PasswordEnv, "changeit")
+	defer os.Unsetenv(output.PasswordEnv)
+
+	cert.Data.PrivateKey = ""
+	if err := saveOutputFile(&fileTransaction{}, output, cert); err == nil {
+		t.Errorf("pkcs12 output without private key must fail")
+	}
+}
+
+func TestSaveJKSFiles(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("CERT_MONITOR_TEST_JKS_PASSWORD", "changeit")
+	defer os.Unsetenv("CERT_MONITOR_TEST_JKS_PASSWORD")
+
+	for _, outputType := range []string{"jks", "jks-truststore"} {
+		output := config.CertConfigOutput{
+			Type:        outputType,
+			Name:        filepath.Join(dir, outputType+".jks"),
+			Perm:        0640,
+			PasswordEnv: "CERT_MONITOR_TEST_JKS_PASSWORD",
+		}
+
+		if err := saveOutputFile(&fileTransaction{}, output, cert); err != nil {
+			t.Fatalf("Error saving %s output: %v", outputType, err)
+		}
+
+		content, err := ioutil.ReadFile(output.Name)
+		if err != nil {
+			t.Fatalf("%s file was not written: %v", outputType, err)
+		}
+		if !bytes.HasPrefix(content, []byte{0xfe, 0xed, 0xfe, 0xed}) {
+			t.Errorf("%s file does not start with the JKS magic number", outputType)
+		}
+	}
+
+	cert.Data.IssuingCa = ""
+	output := config.CertConfigOutput{
+		Type:        "jks-truststore",
+		Name:        filepath.Join(dir, "empty.jks"),
+		PasswordEnv: "CERT_MONITOR_TEST_JKS_PASSWORD",
+	}
+	if err := saveOutputFile(&fileTransaction{}, output, cert); err == nil {
+		t.Errorf("jks-truststore output without CA certificates must fail")
+	}
+}
+
+func testCertConfig(dir string) config.CertConfig {
+	return config.CertConfig{
+		CommonName: "test.domain.tld",
+		MainConfig: &config.MainConfig{DownloadedCertPath: filepath.Join(dir, "cache"), ArchiveRetention: 2},
+		Output: config.CertConfigOutputs{
+			{Type: "bundle", Name: filepath.Join(dir, "out", "bundle.pem"), Perm: 0600, Items: []string{"certificate"}},
+		},
+	}
+}
+
+func TestOutputDirectoryPermissions(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certConfig := testCertConfig(dir)
+	certConfig.Output[0].Name = filepath.Join(dir, "out", "private", "bundle.pem")
+	certConfig.Output[0].Perm = 0640
+	if err := persistCertificate(context.Background(), certConfig, cert); err != nil {
+		t.Fatalf("Error persisting certificate: %v", err)
+	}
+
+	for _, d := range []string{filepath.Join(dir, "out"), filepath.Join(dir, "out", "private")} {
+		info, err := os.Stat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0750 {
+			t.Errorf("Expected directory %v with mode 0750, got %v", d, info.Mode().Perm())
+		}
+	}
+}
+
+func TestPersistCertificateRollback(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certConfig := testCertConfig(dir)
+	if err := persistCertificate(context.Background(), certConfig, cert); err != nil {
+		t.Fatalf("Error persisting certificate: %v", err)
+	}
+	bundle, _ := ioutil.ReadFile(certConfig.Output[0].Name)
+
+	newCert := cert
+	newCert.Data.Certificate = cert.Data.IssuingCa
+	certConfig.Output = append(certConfig.Output, config.CertConfigOutput{
+		Type: "unknown", Name: filepath.Join(dir, "out", "unknown.pem"), Perm: 0600,
+	})
+	if err := persistCertificate(context.Background(), certConfig, newCert); err == nil {
+		t.Fatalf("persistCertificate must fail with an unknown output type")
+	}
+
+	if version, err := liveVersion(certConfig); err != nil || version != 1 {
+		t.Errorf("Live version should still be 1, got %d (%v)", version, err)
+	}
+	if _, err := os.Stat(archiveVersionPath(certConfig, 2)); !os.IsNotExist(err) {
+		t.Errorf("Failed archive version should have been removed")
+	}
+	content, err := ioutil.ReadFile(certConfig.Output[0].Name)
+	if err != nil || string(content) != string(bundle) {
+		t.Errorf("Previous bundle was not restored")
+	}
+}
+
+func TestArchiveAndRollback(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certConfig := testCertConfig(dir)
+	var bundles []string
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			cert.Data.Certificate = cert.Data.IssuingCa
+		}
+		if err := persistCertificate(context.Background(), certConfig, cert); err != nil {
+			t.Fatalf("Error persisting certificate: %v", err)
+		}
+		content, _ := ioutil.ReadFile(certConfig.Output[0].Name)
+		bundles = append(bundles, string(content))
+	}
+
+	versions, err := archiveVersions(certConfig)
+	if err != nil || len(versions) != 2 || versions[0] != 2 || versions[1] != 3 {
+		t.Errorf("Expected archive versions [2 3] with retention 2, got %v (%v)", versions, err)
+	}
+	if version, _ := liveVersion(certConfig); version != 3 {
+		t.Errorf("Expected live version 3, got %d", version)
+	}
+	if _, err := certConfig.LoadCachedCertificate(); err != nil {
+		t.Errorf("Live certificate cannot be loaded: %v", err)
+	}
+
+	previous, err := previousVersion(certConfig)
+	if err != nil || previous != 2 {
+		t.Fatalf("Expected previous version 2, got %d (%v)", previous, err)
+	}
+	if _, err := rollbackCertificate(certConfig, previous); err != nil {
+		t.Fatalf("Error rolling back: %v", err)
+	}
+
+	if version, _ := liveVersion(certConfig); version != 2 {
+		t.Errorf("Expected live version 2 after rollback, got %d", version)
+	}
+	content, _ := ioutil.ReadFile(certConfig.Output[0].Name)
+	if string(content) != bundles[1] {
+		t.Errorf("Output was not rendered from the previous version")
+	}
+	if _, err := previousVersion(certConfig); err == nil {
+		t.Errorf("There should be no version older than 2 left")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file.pem")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(name, []byte(content), 0640, -1, -1); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+		written, _ := ioutil.ReadFile(name)
+		if string(written) != content {
+			t.Errorf("Expected %q, got %q", content, written)
+		}
+	}
+
+	info, _ := os.Stat(name)
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected permissions 0640, got %v", info.Mode().Perm())
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Temporary files were left behind: %d files in directory", len(files))
+	}
+}
+
+func TestReloadQueue(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	envFile := filepath.Join(dir, "env")
+	command := "echo \"$CERT_MONITOR_COMMON_NAME|$CERT_MONITOR_OUTPUT_FILE|$CERT_MONITOR_SERIAL\" >> " + envFile
+
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	queue := &reloadQueue{}
+	queue.add(config.CertConfig{ReloadCommand: command},
+		renewedCertificate{commonName: "a.domain.tld", outputFiles: []string{"/tmp/a.pem"}, notAfter: notAfter, serial: "01"})
+	queue.add(config.CertConfig{ReloadCommand: command, ReloadTimeout: time.Hour},
+		renewedCertificate{commonName: "b.domain.tld", outputFiles: []string{"/tmp/b.pem"}, notAfter: notAfter, serial: "02"})
+
+	if len(queue.commands) != 1 {
+		t.Fatalf("Shared reload commands must run once, got %d commands", len(queue.commands))
+	}
+	if queue.commands[0].timeout != time.Hour {
+		t.Errorf("Expected the longest timeout, got %v", queue.commands[0].timeout)
+	}
+
+	if err := queue.run(); err != nil {
+		t.Fatalf("Error running reload commands: %v", err)
+	}
+
+	content, _ := ioutil.ReadFile(envFile)
+	expected := "a.domain.tld b.domain.tld|/tmp/a.pem /tmp/b.pem|01 02\n"
+	if string(content) != expected {
+		t.Errorf("Expected environment %q, got %q", expected, content)
+	}
+}
+
+func TestReloadQueueFailure(t *testing.T) {
+	queue := &reloadQueue{}
+	queue.add(config.CertConfig{ReloadCommand: "echo broken >&2; exit 3"}, renewedCertificate{})
+	queue.add(config.CertConfig{ReloadCommand: "sleep 10", ReloadTimeout: 100 * time.Millisecond}, renewedCertificate{})
+
+	start := time.Now()
+	err := queue.run()
+	if err == nil {
+		t.Fatalf("Failing reload commands must be reported")
+	}
+	if !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Error should contain the command error output: %v", err)
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Error should report the timeout: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Reload command was not killed after its timeout")
+	}
+}
+
+func TestRunCommandCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := runCommand(ctx, "sleep 10", time.Hour, nil)
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("Expected the command to be interrupted, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Command was not killed when the context was cancelled")
+	}
+
+	if err := runCommand(ctx, "true", time.Hour, nil); err == nil {
+		t.Errorf("Commands must not start once the context is cancelled")
+	}
+}
+
+func TestPersistCertificateCancelled(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certConfig := testCertConfig(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := persistCertificate(ctx, certConfig, cert); err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Fatalf("Cancelled deployment must fail, got %v", err)
+	}
+	if _, err := os.Stat(certConfig.Output[0].Name); !os.IsNotExist(err) {
+		t.Errorf("No output should be written by a cancelled deployment")
+	}
+	if _, err := os.Stat(archiveVersionPath(certConfig, 1)); !os.IsNotExist(err) {
+		t.Errorf("Cancelled archive version should have been removed")
+	}
+}
+
+func TestRunPool(t *testing.T) {
+	var running, maxRunning, calls int32
+	runPool(3, 20, func(i int) bool {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&calls, 1)
+		return true
+	})
+	if calls != 20 {
+		t.Errorf("Expected 20 calls, got %d", calls)
+	}
+	if maxRunning > 3 || maxRunning < 2 {
+		t.Errorf("Expected at most 3 concurrent calls, got %d", maxRunning)
+	}
+
+	var done []int
+	runPool(1, 5, func(i int) bool {
+		done = append(done, i)
+		return i != 1
+	})
+	if len(done) != 2 {
+		t.Errorf("No call should start after a stop, got %v", done)
+	}
+}
+
+func TestCheckCertificatesConcurrently(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	login, err := ioutil.ReadFile(filepath.Join("..", "vault", "testdata", "login.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert, err := ioutil.ReadFile(filepath.Join("..", "vault", "testdata", "new_cert.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			w.Write(login)
+		case "/v1/pki/issue/web":
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			w.Write(newCert)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["unknown role"]}`))
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config.MainConfig{
+		DownloadedCertPath: filepath.Join(dir, "cache"),
+		Concurrency:        4,
+		Vault: config.VaultConfig{
+			BaseUrl:   server.URL,
+			LoginPath: "/v1/auth/approle/login",
+			CertPath:  "/v1/pki/issue/web",
+			Retry:     config.VaultRetryConfig{MaxAttempts: 1},
+		},
+	}
+
+	envFile := filepath.Join(dir, "env")
+	var files, expected []string
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("c%d.domain.tld", i)
+		files = append(files, filepath.Join(dir, name+".yml"))
+		expected = append(expected, name)
+	}
+	files = append(files, filepath.Join(dir, "broken.yml"), filepath.Join(dir, "invalid.yml"))
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".yml")
+		content := fmt.Sprintf(`
+commonName: %s
+ttl: 72h
+renewTtl: 24h
+reloadCommand: echo "$CERT_MONITOR_COMMON_NAME" >> %s
+output:
+- type: bundle
+  name: %s
+  perm: 0600
+  items: [certificate]
+`, name, envFile, filepath.Join(dir, "out", name+".pem"))
+		switch name {
+		case "broken":
+			content += "vault:\n  role: broken\n"
+		case "invalid":
+			content = "commonName: invalid.domain.tld\n"
+		}
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer renewalBackoff.succeeded(filepath.Join(dir, "broken.yml"))
+
+	if err := checkCertificatesAndRenew(context.Background(), cfg, files, false, false); err != nil {
+		t.Fatalf("Failures of a certificate should not affect the others: %v", err)
+	}
+
+	for _, name := range expected {
+		if _, err := os.Stat(filepath.Join(dir, "out", name+".pem")); err != nil {
+			t.Errorf("Certificate %s not deployed: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", "broken.pem")); !os.IsNotExist(err) {
+		t.Errorf("Broken certificate should not be deployed")
+	}
+
+	content, _ := ioutil.ReadFile(envFile)
+	if string(content) != strings.Join(expected, " ")+"\n" {
+		t.Errorf("Expected a single reload in configuration order, got %q", content)
+	}
+	if maxInFlight < 2 {
+		t.Errorf("Certificates should be renewed concurrently, got %d concurrent requests", maxInFlight)
+	}
+
+	// the first failure in configuration order is returned
+	renewalBackoff.succeeded(filepath.Join(dir, "broken.yml"))
+	err = checkCertificatesAndRenew(context.Background(), cfg, files[len(files)-2:], false, true)
+	if err == nil || !strings.Contains(err.Error(), "unknown role") {
+		t.Errorf("Expected the error of the broken certificate, got %v", err)
+	}
+
+	// the certificates deployed before the failure are still reloaded
+	renewalBackoff.succeeded(filepath.Join(dir, "broken.yml"))
+	os.Remove(envFile)
+	deployed := filepath.Join(dir, "c8.domain.tld.yml")
+	content, _ = ioutil.ReadFile(files[0])
+	if err := ioutil.WriteFile(deployed, []byte(strings.Replace(string(content), "c0.domain.tld", "c8.domain.tld", -1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = checkCertificatesAndRenew(context.Background(), cfg, []string{deployed, filepath.Join(dir, "broken.yml")}, false, true)
+	if err == nil || !strings.Contains(err.Error(), "unknown role") {
+		t.Errorf("Expected the error of the broken certificate, got %v", err)
+	}
+	content, _ = ioutil.ReadFile(envFile)
+	if string(content) != "c8.domain.tld\n" {
+		t.Errorf("Deployed certificate should be reloaded despite the failure, got %q", content)
+	}
+}
+
+func TestCheckCertificatesSameCommonName(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	login, err := ioutil.ReadFile(filepath.Join("..", "vault", "testdata", "login.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert, err := ioutil.ReadFile(filepath.Join("..", "vault", "testdata", "new_cert.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			w.Write(login)
+		case "/v1/pki/issue/web":
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			w.Write(newCert)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config.MainConfig{
+		DownloadedCertPath: filepath.Join(dir, "cache"),
+		Concurrency:        2,
+		Vault: config.VaultConfig{
+			BaseUrl:   server.URL,
+			LoginPath: "/v1/auth/approle/login",
+			CertPath:  "/v1/pki/issue/web",
+			Retry:     config.VaultRetryConfig{MaxAttempts: 1},
+		},
+	}
+
+	// two services deploying the same certificate in their own format
+	var files []string
+	for _, name := range []string{"apache", "nginx"} {
+		f := filepath.Join(dir, name+".yml")
+		content := fmt.Sprintf(`
+commonName: shared.domain.tld
+ttl: 72h
+renewTtl: 24h
+output:
+- type: bundle
+  name: %s
+  perm: 0600
+  items: [certificate]
+`, filepath.Join(dir, "out", name+".pem"))
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	if err := checkCertificatesAndRenew(context.Background(), cfg, files, true, false); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+
+	if maxInFlight != 1 {
+		t.Errorf("Certificates with the same commonName should be renewed one at a time, got %d concurrent requests", maxInFlight)
+	}
+	certConfig := config.CertConfig{MainConfig: cfg, CommonName: "shared.domain.tld"}
+	versions, err := archiveVersions(certConfig)
+	if err != nil || len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+		t.Errorf("Expected archive versions [1 2], got %v (%v)", versions, err)
+	}
+	if version, _ := liveVersion(certConfig); version != 2 {
+		t.Errorf("Expected live version 2, got %d", version)
+	}
+	for _, name := range []string{"apache", "nginx"} {
+		if _, err := os.Stat(filepath.Join(dir, "out", name+".pem")); err != nil {
+			t.Errorf("Certificate of %s not deployed: %v", name, err)
+		}
+	}
+}
+
+func TestReloadAfterCancel(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	login, err := ioutil.ReadFile(filepath.Join("..", "vault", "testdata", "login.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert, err := ioutil.ReadFile(filepath.Join("..", "vault", "testdata", "new_cert.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the process is stopped while the second certificate is requested,
+	// once the first one is deployed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var issued int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			w.Write(login)
+		case "/v1/pki/issue/web":
+			if atomic.AddInt32(&issued, 1) > 1 {
+				cancel()
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(newCert)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config.MainConfig{
+		DownloadedCertPath: filepath.Join(dir, "cache"),
+		Vault: config.VaultConfig{
+			BaseUrl:   server.URL,
+			LoginPath: "/v1/auth/approle/login",
+			CertPath:  "/v1/pki/issue/web",
+			Retry:     config.VaultRetryConfig{MaxAttempts: 1},
+		},
+	}
+
+	envFile := filepath.Join(dir, "env")
+	var files []string
+	for _, name := range []string{"first", "second"} {
+		f := filepath.Join(dir, name+".yml")
+		content := fmt.Sprintf(`
+commonName: %s.domain.tld
+ttl: 72h
+renewTtl: 24h
+reloadCommand: echo "$CERT_MONITOR_COMMON_NAME" >> %s
+output:
+- type: bundle
+  name: %s
+  perm: 0600
+  items: [certificate]
+`, name, envFile, filepath.Join(dir, "out", name+".pem"))
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	defer renewalBackoff.succeeded(files[1])
+
+	checkCertificatesAndRenew(ctx, cfg, files, false, false)
+
+	if ctx.Err() == nil {
+		t.Fatalf("The check should have been cancelled")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out", "second.pem")); !os.IsNotExist(err) {
+		t.Errorf("The second certificate should not be deployed")
+	}
+	content, _ := ioutil.ReadFile(envFile)
+	if string(content) != "first.domain.tld\n" {
+		t.Errorf("The deployed certificate should be reloaded when stopping, got %q", content)
+	}
+}
+
+func TestPreDeployHooks(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certConfig := testCertConfig(dir)
+	certConfig.Hooks.PreDeploy = []string{`test -s "$CERT_MONITOR_STAGING_DIR$CERT_MONITOR_OUTPUT_FILE" && test -s "$CERT_MONITOR_STAGED_OUTPUT_FILE"`}
+	if err := persistCertificate(context.Background(), certConfig, cert); err != nil {
+		t.Fatalf("preDeploy hook should find the staged output: %v", err)
+	}
+	bundle, _ := ioutil.ReadFile(certConfig.Output[0].Name)
+
+	cert.Data.Certificate = cert.Data.IssuingCa
+	certConfig.Hooks.PreDeploy = append(certConfig.Hooks.PreDeploy, "echo invalid certificate >&2; exit 1")
+	err := persistCertificate(context.Background(), certConfig, cert)
+	if err == nil || !strings.Contains(err.Error(), "invalid certificate") {
+		t.Fatalf("Failing preDeploy hook must abort the deployment, got %v", err)
+	}
+
+	if version, _ := liveVersion(certConfig); version != 1 {
+		t.Errorf("Live version should still be 1, got %d", version)
+	}
+	if _, err := os.Stat(archiveVersionPath(certConfig, 2)); !os.IsNotExist(err) {
+		t.Errorf("Aborted archive version should have been removed")
+	}
+	content, _ := ioutil.ReadFile(certConfig.Output[0].Name)
+	if string(content) != string(bundle) {
+		t.Errorf("Live output must not be replaced when a preDeploy hook fails")
+	}
+}
+
+func TestFailureHooks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	envFile := filepath.Join(dir, "env")
+	certConfig := testCertConfig(dir)
+	certConfig.Hooks.OnFailure = []string{`echo "$CERT_MONITOR_HOOK|$CERT_MONITOR_COMMON_NAME|$CERT_MONITOR_ERROR" > ` + envFile}
+
+	runFailureHooks(context.Background(), certConfig, fmt.Errorf("vault unavailable"))
+
+	content, _ := ioutil.ReadFile(envFile)
+	if string(content) != "onFailure|test.domain.tld|vault unavailable\n" {
+		t.Errorf("Unexpected onFailure hook environment %q", content)
+	}
+}
+
+func TestRecordMetrics(t *testing.T) {
+	cert := loadTestCertificate(t)
+	leaf, err := parseCertificate(cert.Data.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certConfig := testCertConfig("")
+	certConfig.RenewTTL = 24 * time.Hour
+
+	recordCertificate("metrics.yml", certConfig, leaf)
+	recordRenewal("metrics.yml", certConfig, fmt.Errorf("vault unavailable"))
+	recordVaultRequest("issue", fmt.Errorf("vault unavailable"))
+
+	var b bytes.Buffer
+	registry.WriteTo(&b)
+
+	expected := []string{
+		fmt.Sprintf(`cert_monitor_certificate_not_after_timestamp_seconds{config="metrics.yml",common_name="test.domain.tld"} %d`, leaf.NotAfter.Unix()),
+		fmt.Sprintf(`cert_monitor_certificate_renew_after_timestamp_seconds{config="metrics.yml",common_name="test.domain.tld"} %d`, certConfig.RenewAfter(leaf).Unix()),
+		`cert_monitor_certificate_last_renewal_success{config="metrics.yml",common_name="test.domain.tld"} 0`,
+		`cert_monitor_vault_request_errors_total{operation="issue"}`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(b.String(), e) {
+			t.Errorf("Metric %v missing from:\n%s", e, b.String())
+		}
+	}
+}
+
+func TestLoadStatus(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	mainConfig := &config.MainConfig{DownloadedCertPath: filepath.Join(dir, "cache")}
+	certConfigs := map[string]string{
+		"deployed.yml": `
+commonName: test.domain.tld
+ttl: 72h
+renewTtl: 24h
+output:
+- type: bundle
+  name: ` + filepath.Join(dir, "out", "bundle.pem") + `
+  perm: 0600
+  items: [certificate]
+`,
+		"missing.yml": `
+commonName: missing.domain.tld
+ttl: 72h
+renewTtl: 24h
+`,
+		"invalid.yml": `
+commonName: invalid.domain.tld
+`,
+	}
+	var files []string
+	for name, content := range certConfigs {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	certConfig, err := mainConfig.LoadCertConfig(filepath.Join(dir, "deployed.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := persistCertificate(context.Background(), certConfig, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	states := func(now time.Time) map[string]certificateStatus {
+		result := map[string]certificateStatus{}
+		for _, s := range loadStatus(mainConfig, files, now) {
+			result[filepath.Base(s.Config)] = s
+		}
+		return result
+	}
+
+	status := states(time.Date(2017, 8, 21, 0, 0, 0, 0, time.UTC))
+	deployed := status["deployed.yml"]
+	if deployed.State != stateOK || *deployed.DaysRemaining != 2 {
+		t.Errorf("Expected ok with 2 days remaining, got %v %v", deployed.State, *deployed.DaysRemaining)
+	}
+	if deployed.Serial != "0e:54:22:0a:25:d9:86:65:87:7a:87:4a:95:32:38:4f:18:bd:a4:be" {
+		t.Errorf("Unexpected serial %v", deployed.Serial)
+	}
+	if strings.Join(deployed.SANs, ",") != "s01-test-vince-test.web.capitale.qc.ca,n1-s01-test-vince-test.web.capitale.qc.ca" {
+		t.Errorf("Unexpected SANs %v", deployed.SANs)
+	}
+	if deployed.KeyType != config.KeyTypeRSA || deployed.KeyBits == 0 {
+		t.Errorf("Unexpected key type %v %v", deployed.KeyType, deployed.KeyBits)
+	}
+	if status["missing.yml"].State != stateMissing || status["missing.yml"].Error == "" {
+		t.Errorf("Expected missing with an error, got %+v", status["missing.yml"])
+	}
+	if status["invalid.yml"].State != stateConfigError || !strings.Contains(status["invalid.yml"].Error, "renewTtl") {
+		t.Errorf("Expected config-error with the reason, got %+v", status["invalid.yml"])
+	}
+
+	if s := states(time.Date(2017, 8, 22, 12, 0, 0, 0, time.UTC))["deployed.yml"].State; s != stateRenewDue {
+		t.Errorf("Expected renew-due, got %v", s)
+	}
+	if s := states(time.Date(2017, 8, 24, 0, 0, 0, 0, time.UTC))["deployed.yml"].State; s != stateExpired {
+		t.Errorf("Expected expired, got %v", s)
+	}
+
+	mainConfig.RenewJitter = 12 * time.Hour
+	jittered := states(time.Date(2017, 8, 21, 0, 0, 0, 0, time.UTC))["deployed.yml"]
+	if jittered.RenewJitter == "" || jittered.RenewAfter >= deployed.RenewAfter {
+		t.Errorf("Expected a renewal before %v with a jitter, got %v (%v)", deployed.RenewAfter, jittered.RenewAfter, jittered.RenewJitter)
+	}
+}
+
+func TestNextCheck(t *testing.T) {
+	cert := loadTestCertificate(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	mainConfig := &config.MainConfig{DownloadedCertPath: filepath.Join(dir, "cache"), CheckInterval: time.Hour}
+	certConfigs := map[string]string{
+		"deployed.yml": "commonName: test.domain.tld\nttl: 72h\nrenewTtl: 24h\n",
+		"missing.yml":  "commonName: missing.domain.tld\nttl: 72h\nrenewTtl: 24h\n",
+		"invalid.yml":  "commonName: invalid.domain.tld\n",
+	}
+	var files []string
+	for name, content := range certConfigs {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	certConfig, err := mainConfig.LoadCertConfig(filepath.Join(dir, "deployed.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := persistCertificate(context.Background(), certConfig, cert); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := parseCertificate(cert.Data.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewAfter := certConfig.RenewAfter(leaf)
+
+	now := renewAfter.Add(-3 * time.Hour)
+	if next := nextCheck(mainConfig, files, now); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the rescan at %v, got %v", now.Add(time.Hour), next)
+	}
+
+	now = renewAfter.Add(-10 * time.Minute)
+	if next := nextCheck(mainConfig, files, now); !next.Equal(renewAfter) {
+		t.Errorf("Expected the renewal at %v, got %v", renewAfter, next)
+	}
+
+	missing := filepath.Join(dir, "missing.yml")
+	retry := renewalBackoff.failed(missing, mainConfig, now)
+	defer renewalBackoff.succeeded(missing)
+	if next := nextCheck(mainConfig, files, now); !next.Equal(retry) {
+		t.Errorf("Expected the retry of the failing certificate at %v, got %v", retry, next)
+	}
+
+	now = renewAfter.Add(time.Hour)
+	if next := nextCheck(mainConfig, files, now); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("Past renewals should be ignored, got %v", next)
+	}
+}
+
+func TestLastValidCertConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "edited.yml")
+	if _, ok := lastValidCertConfig(&config.MainConfig{}, f); ok {
+		t.Errorf("No configuration expected before a valid one is loaded")
+	}
+
+	rememberCertConfig(f, config.CertConfig{CommonName: "edited.domain.tld", MainConfig: &config.MainConfig{CheckInterval: time.Hour}})
+	certConfig, ok := lastValidCertConfig(&config.MainConfig{CheckInterval: time.Minute}, f)
+	if !ok || certConfig.CommonName != "edited.domain.tld" {
+		t.Fatalf("Expected the last valid configuration, got %+v", certConfig)
+	}
+	if certConfig.MainConfig.CheckInterval != time.Minute {
+		t.Errorf("The last valid configuration should use the current main configuration")
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	days := 2
+	statuses := []certificateStatus{
+		{Config: "a.yml", CommonName: "a.domain.tld", DaysRemaining: &days, State: stateOK},
+		{Config: "b.yml", State: stateConfigError, Error: "ttl is not set"},
+	}
+
+	var b bytes.Buffer
+	if err := writeStatus(&b, StatusFormatJSON, statuses); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON status: %v", err)
+	}
+	if len(decoded) != 2 || decoded[0]["daysRemaining"] != 2.0 || decoded[1]["error"] != "ttl is not set" {
+		t.Errorf("Unexpected JSON status %s", b.String())
+	}
+
+	b.Reset()
+	if err := writeStatus(&b, StatusFormatYAML, statuses); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "state: config-error") {
+		t.Errorf("Unexpected YAML status %s", b.String())
+	}
+
+	if err := writeStatus(&b, "xml", statuses); err == nil {
+		t.Errorf("Unknown format is supposed to be an error")
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	now := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)
+	status := func(name string, remaining time.Duration) certificateStatus {
+		days := daysRemaining(remaining)
+		return certificateStatus{
+			Config:        name + ".yml",
+			CommonName:    name,
+			DaysRemaining: &days,
+			State:         stateOK,
+			notAfter:      now.Add(remaining),
+		}
+	}
+	warning, critical := 14*24*time.Hour, 7*24*time.Hour
+
+	tests := []struct {
+		statuses []certificateStatus
+		code     int
+		output   string
+	}{
+		{
+			[]certificateStatus{status("a", 30*24*time.Hour)},
+			CheckOK,
+			"CERT-MONITOR OK - 1 ok | 'a'=30;14;7",
+		},
+		{
+			[]certificateStatus{status("a", 30*24*time.Hour), status("b", 10*24*time.Hour)},
+			CheckWarning,
+			"CERT-MONITOR WARNING - 1 warning, 1 ok: b expires in 10 days | 'a'=30;14;7 'b'=10;14;7",
+		},
+		{
+			[]certificateStatus{status("a", -time.Hour), {Config: "c.yml", State: stateConfigError}},
+			CheckCritical,
+			"CERT-MONITOR CRITICAL - 1 critical, 1 unknown: a expired; c.yml invalid configuration | 'a'=-1;14;7",
+		},
+		{
+			[]certificateStatus{{Config: "c.yml", State: stateConfigError}},
+			CheckUnknown,
+			"CERT-MONITOR UNKNOWN - 1 unknown: c.yml invalid configuration",
+		},
+		{
+			[]certificateStatus{{Config: "m.yml", CommonName: "m", State: stateMissing}},
+			CheckCritical,
+			"CERT-MONITOR CRITICAL - 1 critical: m missing",
+		},
+	}
+
+	for _, test := range tests {
+		code, output := checkStatus(test.statuses, warning, critical, now)
+		if code != test.code || output != test.output {
+			t.Errorf("Expected %d %q, got %d %q", test.code, test.output, code, output)
+		}
+	}
+}
+
+func TestCertVaultPaths(t *testing.T) {
+	vaultConfig := config.VaultConfig{CertPath: "/v1/pki/issue/webservers"}
+
+	tests := []struct {
+		certVault config.CertVaultConfig
+		certPath  string
+		signPath  string
+	}{
+		{config.CertVaultConfig{}, "/v1/pki/issue/webservers", "/v1/pki/sign/webservers"},
+		{config.CertVaultConfig{Role: "databases"}, "/v1/pki/issue/databases", "/v1/pki/sign/databases"},
+		{config.CertVaultConfig{PkiMount: "pki-internal"}, "/v1/pki-internal/issue/webservers", "/v1/pki-internal/sign/webservers"},
+		{config.CertVaultConfig{PkiMount: "/pki-mtls/", Role: "clients"}, "/v1/pki-mtls/issue/clients", "/v1/pki-mtls/sign/clients"},
+		{config.CertVaultConfig{CertPath: "/v1/other/issue/role"}, "/v1/other/issue/role", "/v1/other/sign/role"},
+		{config.CertVaultConfig{CertPath: "/v1/other/issue/role", SignPath: "/v1/other/sign-verbatim"}, "/v1/other/issue/role", "/v1/other/sign-verbatim"},
+	}
+	for _, test := range tests {
+		certPath, signPath, err := certVaultPaths(vaultConfig, test.certVault)
+		if err != nil {
+			t.Errorf("Error %v", err)
+		}
+		if certPath != test.certPath || signPath != test.signPath {
+			t.Errorf("Expected %v %v for %+v, got %v %v", test.certPath, test.signPath, test.certVault, certPath, signPath)
+		}
+	}
+
+	if _, _, err := certVaultPaths(config.VaultConfig{CertPath: "/v1/custom"}, config.CertVaultConfig{Role: "databases"}); err == nil {
+		t.Errorf("Role override of a path without /issue/ is supposed to be an error")
+	}
+}
+
+func TestGetVaultClient(t *testing.T) {
+	mainConfig := &config.MainConfig{Vault: config.VaultConfig{
+		BaseUrl:   "http://127.0.0.1:8200",
+		CertPath:  "/v1/pki/issue/webservers",
+		Namespace: "web",
+	}}
+	certConfig := func(certVault config.CertVaultConfig) config.CertConfig {
+		return config.CertConfig{MainConfig: mainConfig, Vault: certVault}
+	}
+
+	web, err := getVaultClient(certConfig(config.CertVaultConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web.Namespace != "web" || web.CertPath.Path != "/v1/pki/issue/webservers" {
+		t.Errorf("Unexpected client %v %v", web.Namespace, web.CertPath.Path)
+	}
+
+	if again, _ := getVaultClient(certConfig(config.CertVaultConfig{})); again != web {
+		t.Errorf("Client should be reused for the same role and namespace")
+	}
+
+	db, err := getVaultClient(certConfig(config.CertVaultConfig{Namespace: "db", Role: "databases"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db == web || db.Namespace != "db" || db.CertPath.Path != "/v1/pki/issue/databases" {
+		t.Errorf("Unexpected client %v %v", db.Namespace, db.CertPath.Path)
+	}
+	if db.AuthNamespace != "web" || db.Tokens != web.Tokens {
+		t.Errorf("Per-certificate namespace should log in to the main namespace with the same token, got %v", db.AuthNamespace)
+	}
+}
+
+func TestVaultRetryPolicy(t *testing.T) {
+	policy := vaultRetryPolicy(config.VaultRetryConfig{MaxAttempts: 5, Jitter: 0.5})
+	if policy.MaxAttempts != 5 || policy.Jitter != 0.5 {
+		t.Errorf("Unexpected retry policy %+v", policy)
+	}
+	if policy.BaseBackoff != vault.DefaultRetryPolicy.BaseBackoff || len(policy.RetryableStatusCodes) == 0 {
+		t.Errorf("Unset fields should keep their default: %+v", policy)
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	cfg := &config.MainConfig{
+		CheckInterval:  time.Hour,
+		FailureBackoff: config.FailureBackoffConfig{Base: time.Minute, Max: 5 * time.Minute},
+	}
+	backoff := &failureBackoff{}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if !backoff.ready("a.yaml", now) {
+		t.Errorf("Certificate without failure should be ready")
+	}
+	if _, ok := backoff.nextRetry(now); ok {
+		t.Errorf("No retry expected without failure")
+	}
+
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if next := backoff.failed("a.yaml", cfg, now); next.Sub(now) != expected {
+			t.Errorf("Expected a retry after %v, got %v", expected, next.Sub(now))
+		}
+	}
+	if backoff.ready("a.yaml", now.Add(4*time.Minute)) || !backoff.ready("a.yaml", now.Add(5*time.Minute)) {
+		t.Errorf("Certificate should be ready only after its backoff")
+	}
+
+	backoff.failed("b.yaml", cfg, now)
+	if next, ok := backoff.nextRetry(now); !ok || !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected the earliest retry at %v, got %v", now.Add(time.Minute), next)
+	}
+	if next, ok := backoff.nextRetry(now.Add(time.Minute)); !ok || !next.Equal(now.Add(5*time.Minute)) {
+		t.Errorf("Past retries should be ignored, got %v", next)
+	}
+
+	backoff.succeeded("a.yaml")
+	if !backoff.ready("a.yaml", now) {
+		t.Errorf("Certificate should be ready after a success")
+	}
+	if next := backoff.failed("a.yaml", cfg, now); next.Sub(now) != time.Minute {
+		t.Errorf("Backoff should restart after a success, got %v", next.Sub(now))
+	}
+}
+
+func TestPEMCertificate(t *testing.T) {
+	cert := loadTestCertificate(t)
+
+	bundle := cert
+	bundle.Data.Certificate = cert.Data.Certificate + "\n" + cert.Data.PrivateKey + "\n" + cert.Data.IssuingCa
+	bundle.Data.IssuingCa = ""
+	bundle.Data.PrivateKey = ""
+
+	der := cert
+	toDER := func(content string) string {
+		block, _ := pem.Decode([]byte(content))
+		return base64.StdEncoding.EncodeToString(block.Bytes)
+	}
+	der.Data.Certificate = toDER(cert.Data.Certificate)
+	der.Data.IssuingCa = toDER(cert.Data.IssuingCa)
+	der.Data.PrivateKey = toDER(cert.Data.PrivateKey)
+	der.Data.Chain = nil
+	for _, c := range cert.Data.Chain {
+		der.Data.Chain = append(der.Data.Chain, toDER(c))
+	}
+
+	for format, response := range map[string]vault.CertResponse{
+		config.FormatPEM:       cert,
+		config.FormatPEMBundle: bundle,
+		config.FormatDER:       der,
+	} {
+		converted, err := pemCertificate(format, response)
+		if err != nil {
+			t.Errorf("%s: Error %v", format, err)
+			continue
+		}
+		if converted.Data.Certificate != strings.TrimSpace(cert.Data.Certificate) {
+			t.Errorf("%s: Unexpected certificate %v", format, converted.Data.Certificate)
+		}
+		if converted.Data.IssuingCa != strings.TrimSpace(cert.Data.IssuingCa) {
+			t.Errorf("%s: Unexpected issuing CA %v", format, converted.Data.IssuingCa)
+		}
+		if _, err := parsePrivateKey(converted.Data.PrivateKey); err != nil {
+			t.Errorf("%s: Unexpected private key: %v", format, err)
+		}
+	}
+
+	if _, err := pemCertificate(config.FormatPEMBundle, vault.CertResponse{}); err == nil {
+		t.Errorf("Empty pem_bundle is supposed to be an error")
+	}
+	if _, err := pemCertificate("p7b", cert); err == nil {
+		t.Errorf("Unknown format is supposed to be an error")
+	}
+}
+
+func TestInitCertRequest(t *testing.T) {
+	certConfig := config.CertConfig{
+		CommonName:        "test.domain.tld",
+		AlternateNames:    []string{"www.domain.tld"},
+		IPSans:            []string{"10.0.0.1", "::1"},
+		URISans:           []string{"spiffe://domain.tld/ns/web/sa/nginx"},
+		OtherSans:         []string{"1.3.6.1.4.1.311.20.2.3;UTF8:web@domain.tld"},
+		ExcludeCNFromSans: true,
+		PrivateKeyFormat:  config.PrivateKeyFormatPKCS8,
+		Format:            config.FormatDER,
+	}
+
+	content, err := json.Marshal(initCertRequest(certConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"common_name":"test.domain.tld","alt_names":"www.domain.tld","ip_sans":"10.0.0.1,::1",` +
+		`"uri_sans":"spiffe://domain.tld/ns/web/sa/nginx","other_sans":"1.3.6.1.4.1.311.20.2.3;UTF8:web@domain.tld",` +
+		`"exclude_cn_from_sans":true,"private_key_format":"pkcs8","format":"der"}`
+	if string(content) != expected {
+		t.Errorf("Unexpected request %s", content)
+	}
+}
+
+func TestGeneratePrivateKey(t *testing.T) {
+	tests := []struct {
+		keyType   string
+		keyBits   int
+		pemType   string
+		checkSize func(crypto.Signer) int
+		bits      int
+	}{
+		{"", 0, "RSA PRIVATE KEY", func(k crypto.Signer) int { return k.(*rsa.PrivateKey).N.BitLen() }, 2048},
+		{config.KeyTypeRSA, 3072, "RSA PRIVATE KEY", func(k crypto.Signer) int { return k.(*rsa.PrivateKey).N.BitLen() }, 3072},
+		{config.KeyTypeEC, 0, "EC PRIVATE KEY", func(k crypto.Signer) int { return k.(*ecdsa.PrivateKey).Curve.Params().BitSize }, 256},
+		{config.KeyTypeEC, 384, "EC PRIVATE KEY", func(k crypto.Signer) int { return k.(*ecdsa.PrivateKey).Curve.Params().BitSize }, 384},
+		{config.KeyTypeEd25519, 0, "PRIVATE KEY", func(k crypto.Signer) int { return len(k.(ed25519.PrivateKey)) }, ed25519.PrivateKeySize},
+	}
+
+	for _, test := range tests {
+		key, keyPEM, err := generatePrivateKey(config.CertConfig{KeyType: test.keyType, KeyBits: test.keyBits})
+		if err != nil {
+			t.Fatalf("%v %v: %v", test.keyType, test.keyBits, err)
+		}
+		if bits := test.checkSize(key); bits != test.bits {
+			t.Errorf("%v %v: expected a size of %v, got %v", test.keyType, test.keyBits, test.bits, bits)
+		}
+
+		block, _ := pem.Decode([]byte(keyPEM))
+		if block == nil || block.Type != test.pemType {
+			t.Fatalf("%v %v: expected a %v PEM block, got %q", test.keyType, test.keyBits, test.pemType, keyPEM)
+		}
+		var parsed interface{}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			parsed, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			t.Fatalf("%v %v: error parsing the encoded key: %v", test.keyType, test.keyBits, err)
+		}
+		if !reflect.DeepEqual(parsed.(crypto.Signer).Public(), key.Public()) {
+			t.Errorf("%v %v: the encoded key does not match the generated key", test.keyType, test.keyBits)
+		}
+	}
+
+	if _, _, err := generatePrivateKey(config.CertConfig{KeyType: config.KeyTypeEC, KeyBits: 512}); err == nil {
+		t.Errorf("Unsupported EC key size should fail")
+	}
+	if _, _, err := generatePrivateKey(config.CertConfig{KeyType: "dsa"}); err == nil {
+		t.Errorf("Unsupported key type should fail")
+	}
+}
+
+func TestCreateCSR(t *testing.T) {
+	certConfig := config.CertConfig{
+		CommonName:     "test.domain.tld",
+		AlternateNames: []string{"www.domain.tld", "api.domain.tld"},
+		IPSans:         []string{"10.0.0.1", "::1"},
+		URISans:        []string{"spiffe://domain.tld/ns/web/sa/nginx"},
+	}
+
+	for _, keyType := range []string{config.KeyTypeRSA, config.KeyTypeEC, config.KeyTypeEd25519} {
+		certConfig.KeyType = keyType
+		key, _, err := generatePrivateKey(certConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		csrPEM, err := createCSR(certConfig, key)
+		if err != nil {
+			t.Fatalf("%v: %v", keyType, err)
+		}
+		block, _ := pem.Decode([]byte(csrPEM))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			t.Fatalf("%v: expected a CERTIFICATE REQUEST PEM block, got %q", keyType, csrPEM)
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatalf("%v: %v", keyType, err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("%v: invalid CSR signature: %v", keyType, err)
+		}
+		if !reflect.DeepEqual(csr.PublicKey, key.Public()) {
+			t.Errorf("%v: the CSR is not for the generated key", keyType)
+		}
+
+		if csr.Subject.CommonName != "test.domain.tld" {
+			t.Errorf("%v: unexpected common name %v", keyType, csr.Subject.CommonName)
+		}
+		if strings.Join(csr.DNSNames, ",") != "www.domain.tld,api.domain.tld" {
+			t.Errorf("%v: unexpected DNS SANs %v", keyType, csr.DNSNames)
+		}
+		var ips []string
+		for _, ip := range csr.IPAddresses {
+			ips = append(ips, ip.String())
+		}
+		if strings.Join(ips, ",") != "10.0.0.1,::1" {
+			t.Errorf("%v: unexpected IP SANs %v", keyType, ips)
+		}
+		if len(csr.URIs) != 1 || csr.URIs[0].String() != "spiffe://domain.tld/ns/web/sa/nginx" {
+			t.Errorf("%v: unexpected URI SANs %v", keyType, csr.URIs)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/vdesjardins/cert-monitor/config"
+)
+
+const (
+	defaultRSAKeyBits = 2048
+	defaultECKeyBits  = 256
+)
+
+var ellipticCurves = map[int]elliptic.Curve{
+	224: elliptic.P224(),
+	256: elliptic.P256(),
+	384: elliptic.P384(),
+	521: elliptic.P521(),
+}
+
+// generatePrivateKey creates a new private key on the local host according
+// to the certificate key type and size and returns it along with its PEM
+// encoding.
+func generatePrivateKey(certConfig config.CertConfig) (crypto.Signer, string, error) {
+	switch certConfig.KeyType {
+	case "", config.KeyTypeRSA:
+		bits := certConfig.KeyBits
+		if bits == 0 {
+			bits = defaultRSAKeyBits
+		}
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error generating RSA private key: %v", err)
+		}
+		block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+
+		return key, string(pem.EncodeToMemory(block)), nil
+	case config.KeyTypeEC:
+		bits := certConfig.KeyBits
+		if bits == 0 {
+			bits = defaultECKeyBits
+		}
+		curve, ok := ellipticCurves[bits]
+		if !ok {
+			return nil, "", fmt.Errorf("Error: unsupported EC key size %d", bits)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error generating EC private key: %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error encoding EC private key: %v", err)
+		}
+		block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+
+		return key, string(pem.EncodeToMemory(block)), nil
+	case config.KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error generating Ed25519 private key: %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error encoding Ed25519 private key: %v", err)
+		}
+		block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+
+		return key, string(pem.EncodeToMemory(block)), nil
+	default:
+		return nil, "", fmt.Errorf("Error: unsupported key type %s", certConfig.KeyType)
+	}
+}
+
+// createCSR builds a PEM encoded certificate signing request for the
+// common name and alternate names of the certificate configuration.
+func createCSR(certConfig config.CertConfig, key crypto.Signer) (string, error) {
+	template := x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: certConfig.CommonName},
+		DNSNames: certConfig.AlternateNames,
+	}
+	for _, ip := range certConfig.IPSans {
+		template.IPAddresses = append(template.IPAddresses, net.ParseIP(ip))
+	}
+	for _, uri := range certConfig.URISans {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", fmt.Errorf("Error parsing URI SAN %v: %v", uri, err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return "", fmt.Errorf("Error creating certificate signing request: %v", err)
+	}
+
+	block := &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}
+
+	return string(pem.EncodeToMemory(block)), nil
+}
@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes content to a temporary file in the directory of
+// name, syncs it to disk and renames it over name so readers only ever see
+// the previous or the new content. The ownership is changed before the
+// rename unless uid and gid are -1.
+func writeFileAtomic(name string, content []byte, perm os.FileMode, uid, gid int) error {
+	dir := filepath.Dir(name)
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Error: unable to create temporary file in %s: %v", dir, err)
+	}
+	tmpName := tmp.Name()
+
+	cleanup := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	if _, err := tmp.Write(content); err != nil {
+		return cleanup(fmt.Errorf("Error: unable to write file %s: %v", tmpName, err))
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return cleanup(fmt.Errorf("Error: unable to change permissions of %s: %v", tmpName, err))
+	}
+	if uid != -1 || gid != -1 {
+		if err := tmp.Chown(uid, gid); err != nil {
+			return cleanup(fmt.Errorf("Error: failed to change file ownership on %s to %d:%d: %v", tmpName, uid, gid, err))
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return cleanup(fmt.Errorf("Error: unable to sync file %s: %v", tmpName, err))
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("Error: unable to close file %s: %v", tmpName, err)
+	}
+
+	if err := os.Rename(tmpName, name); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("Error: unable to rename %s to %s: %v", tmpName, name, err)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes directory entries so a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Error: unable to open directory %s: %v", dir, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("Error: unable to sync directory %s: %v", dir, err)
+	}
+	return nil
+}
+
+type fileBackup struct {
+	name    string
+	existed bool
+	content []byte
+	perm    os.FileMode
+	uid     int
+	gid     int
+}
+
+// fileTransaction records the previous state of every file it writes so a
+// failed deployment can be rolled back to the previous certificate set.
+type fileTransaction struct {
+	backups []fileBackup
+	saved   map[string]bool
+}
+
+func (t *fileTransaction) writeFile(name string, content []byte, perm os.FileMode, uid, gid int) error {
+	if err := t.backup(name); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(name, content, perm, uid, gid)
+}
+
+func (t *fileTransaction) backup(name string) error {
+	if t.saved == nil {
+		t.saved = map[string]bool{}
+	}
+	if t.saved[name] {
+		return nil
+	}
+
+	backup := fileBackup{name: name, uid: -1, gid: -1}
+
+	info, err := os.Stat(name)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("Error: unable to backup %s: %v", name, err)
+	default:
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("Error: unable to backup %s: %v", name, err)
+		}
+		backup.existed = true
+		backup.content = content
+		backup.perm = info.Mode().Perm()
+		backup.uid, backup.gid = fileOwner(info)
+	}
+
+	t.backups = append(t.backups, backup)
+	t.saved[name] = true
+	return nil
+}
+
+// rollback restores every file written by the transaction, in reverse
+// order, to its state before the transaction started.
+func (t *fileTransaction) rollback() error {
+	var failed []string
+
+	for i := len(t.backups) - 1; i >= 0; i-- {
+		b := t.backups[i]
+
+		var err error
+		if b.existed {
+			log.Printf("Restoring previous file %s\n", b.name)
+			err = writeFileAtomic(b.name, b.content, b.perm, b.uid, b.gid)
+		} else {
+			log.Printf("Removing new file %s\n", b.name)
+			if err = os.Remove(b.name); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	t.backups = nil
+	t.saved = nil
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Error rolling back files: %v", failed)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package controller
+
+import (
+	"os"
+)
+
+// fileOwner returns -1 as files have no numeric owner on this platform, so
+// the ownership is left untouched.
+func fileOwner(info os.FileInfo) (int, int) {
+	return -1, -1
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vdesjardins/cert-monitor/config"
+	"github.com/vdesjardins/cert-monitor/vault"
+)
+
+// runHooks executes the commands of a hook stage in order and stops at the
+// first failure.
+func runHooks(ctx context.Context, stage string, certConfig config.CertConfig, commands []string, env []string) error {
+	timeout := certConfig.Hooks.Timeout
+	if timeout == 0 {
+		timeout = defaultReloadTimeout
+	}
+
+	env = append(env, "CERT_MONITOR_HOOK="+stage)
+	for _, command := range commands {
+		log.Printf("Running %s hook for %s\n", stage, certConfig.CommonName)
+		if err := runCommand(ctx, command, timeout, env); err != nil {
+			return fmt.Errorf("Error: %s hook `%v' failed for %s: %v", stage, command, certConfig.CommonName, err)
+		}
+	}
+	return nil
+}
+
+// runPreDeployHooks renders the outputs of the new certificate in a staging
+// directory and runs the preDeploy hooks against them. The staged files
+// mirror the output paths under CERT_MONITOR_STAGING_DIR.
+func runPreDeployHooks(ctx context.Context, certConfig config.CertConfig, cert vault.CertResponse) error {
+	if len(certConfig.Hooks.PreDeploy) == 0 {
+		return nil
+	}
+
+	leaf, err := parseCertificate(cert.Data.Certificate)
+	if err != nil {
+		return fmt.Errorf("Error parsing new certificate: %v", err)
+	}
+
+	stagingDir, err := ioutil.TempDir("", "cert-monitor-staging")
+	if err != nil {
+		return fmt.Errorf("Error creating staging directory: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	var stagedFiles []string
+	for _, output := range certConfig.Output {
+		staged := output
+		staged.Name = filepath.Join(stagingDir, output.Name)
+		if err := saveOutputFile(&fileTransaction{}, staged, cert); err != nil {
+			return fmt.Errorf("Error staging output %s: %v", output.Name, err)
+		}
+		stagedFiles = append(stagedFiles, staged.Name)
+	}
+
+	reload := reloadCommand{certs: []renewedCertificate{newRenewedCertificate(certConfig, leaf)}}
+	env := append(reload.environment(),
+		"CERT_MONITOR_STAGING_DIR="+stagingDir,
+		"CERT_MONITOR_STAGED_OUTPUT_FILE="+strings.Join(stagedFiles, " "))
+
+	return runHooks(ctx, "preDeploy", certConfig, certConfig.Hooks.PreDeploy, env)
+}
+
+func runPostDeployHooks(ctx context.Context, certConfig config.CertConfig, cert renewedCertificate) error {
+	reload := reloadCommand{certs: []renewedCertificate{cert}}
+
+	return runHooks(ctx, "postDeploy", certConfig, certConfig.Hooks.PostDeploy, reload.environment())
+}
+
+// runFailureHooks notifies the onFailure hooks of a failed renewal. Their
+// own failures are only logged, and they are not run while stopping.
+func runFailureHooks(ctx context.Context, certConfig config.CertConfig, renewErr error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	env := []string{
+		"CERT_MONITOR_COMMON_NAME=" + certConfig.CommonName,
+		"CERT_MONITOR_ERROR=" + renewErr.Error(),
+	}
+
+	if err := runHooks(ctx, "onFailure", certConfig, certConfig.Hooks.OnFailure, env); err != nil {
+		log.Println(err)
+	}
+}
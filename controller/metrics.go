@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/vdesjardins/cert-monitor/config"
+	"github.com/vdesjardins/cert-monitor/metrics"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	certNotAfter = registry.NewGaugeVec("cert_monitor_certificate_not_after_timestamp_seconds",
+		"Expiration time of the deployed certificate.", "config", "common_name")
+	certRenewAfter = registry.NewGaugeVec("cert_monitor_certificate_renew_after_timestamp_seconds",
+		"Time after which the certificate is renewed.", "config", "common_name")
+	certLastRenewalSuccess = registry.NewGaugeVec("cert_monitor_certificate_last_renewal_success",
+		"Whether the last renewal of the certificate succeeded (1) or failed (0).", "config", "common_name")
+	certLastRenewal = registry.NewGaugeVec("cert_monitor_certificate_last_renewal_timestamp_seconds",
+		"Time of the last renewal attempt of the certificate.", "config", "common_name")
+	certLastError = registry.NewGaugeVec("cert_monitor_certificate_last_error_timestamp_seconds",
+		"Time of the last renewal failure of the certificate.", "config", "common_name")
+	configErrors = registry.NewCounterVec("cert_monitor_config_errors_total",
+		"Certificate configurations that failed to load.", "config")
+	vaultRequests = registry.NewCounterVec("cert_monitor_vault_requests_total",
+		"Requests made to Vault by operation.", "operation")
+	vaultErrors = registry.NewCounterVec("cert_monitor_vault_request_errors_total",
+		"Failed requests made to Vault by operation.", "operation")
+	reloadCommands = registry.NewCounterVec("cert_monitor_reload_commands_total",
+		"Reload commands executed by result.", "result")
+	lastCheck = registry.NewGaugeVec("cert_monitor_last_check_timestamp_seconds",
+		"Time of the last check of the certificates.")
+)
+
+// serveMetrics starts serving the metrics on listen in the background.
+func serveMetrics(listen string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("Error listening for metrics on %v: %v", listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	log.Printf("Serving metrics on %v/metrics\n", l.Addr())
+	go func() {
+		log.Printf("Metrics server stopped: %v\n", http.Serve(l, mux))
+	}()
+
+	return nil
+}
+
+func recordCertificate(file string, certConfig config.CertConfig, cert *x509.Certificate) {
+	certNotAfter.Set(timestamp(cert.NotAfter), file, certConfig.CommonName)
+	certRenewAfter.Set(timestamp(certConfig.RenewAfter(cert)), file, certConfig.CommonName)
+}
+
+func recordRenewal(file string, certConfig config.CertConfig, err error) {
+	now := time.Now()
+
+	certLastRenewal.Set(timestamp(now), file, certConfig.CommonName)
+	if err != nil {
+		certLastRenewalSuccess.Set(0, file, certConfig.CommonName)
+		certLastError.Set(timestamp(now), file, certConfig.CommonName)
+		return
+	}
+	certLastRenewalSuccess.Set(1, file, certConfig.CommonName)
+}
+
+func recordVaultRequest(operation string, err error) {
+	vaultRequests.Inc(operation)
+	if err != nil {
+		vaultErrors.Inc(operation)
+	}
+}
+
+func recordReload(err error) {
+	if err != nil {
+		reloadCommands.Inc("failure")
+		return
+	}
+	reloadCommands.Inc("success")
+}
+
+func timestamp(t time.Time) float64 {
+	return float64(t.Unix())
+}
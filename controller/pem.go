@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/vdesjardins/cert-monitor/config"
+	"github.com/vdesjardins/cert-monitor/vault"
+)
+
+// parseCertificate decodes the first PEM block of content as a certificate.
+func parseCertificate(content string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(content))
+	if block == nil {
+		return nil, fmt.Errorf("Error: no PEM data found in certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parsePrivateKey decodes a PKCS#1, SEC 1 or PKCS#8 PEM encoded private key.
+func parsePrivateKey(content string) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(content))
+	if block == nil {
+		return nil, fmt.Errorf("Error: no PEM data found in private key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Error: unsupported private key type %s", block.Type)
+	}
+}
+
+// parseCertificateChain returns the CA chain of the response, falling back
+// to the issuing CA when Vault did not return a chain.
+func parseCertificateChain(cert vault.CertResponse) ([]*x509.Certificate, error) {
+	chain := cert.Data.Chain
+	if len(chain) == 0 && cert.Data.IssuingCa != "" {
+		chain = []string{cert.Data.IssuingCa}
+	}
+
+	var certs []*x509.Certificate
+	for _, v := range chain {
+		c, err := parseCertificate(v)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CA chain: %v", err)
+		}
+		certs = append(certs, c)
+	}
+
+	return certs, nil
+}
+
+// parseKeyAndCertificates decodes the private key, the certificate and the
+// CA chain of the response for the binary keystore outputs.
+func parseKeyAndCertificates(cert vault.CertResponse) (crypto.PrivateKey, *x509.Certificate, []*x509.Certificate, error) {
+	if cert.Data.PrivateKey == "" {
+		return nil, nil, nil, fmt.Errorf("Error: no private key available")
+	}
+
+	leaf, err := parseCertificate(cert.Data.Certificate)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Error parsing certificate: %v", err)
+	}
+	key, err := parsePrivateKey(cert.Data.PrivateKey)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Error parsing private key: %v", err)
+	}
+	chain, err := parseCertificateChain(cert)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return key, leaf, chain, nil
+}
+
+// parseCACertificates returns the issuing CA and the CA chain of the
+// response without duplicates.
+func parseCACertificates(cert vault.CertResponse) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for _, v := range append([]string{cert.Data.IssuingCa}, cert.Data.Chain...) {
+		if v == "" {
+			continue
+		}
+		c, err := parseCertificate(v)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing CA certificate: %v", err)
+		}
+
+		duplicate := false
+		for _, existing := range certs {
+			if existing.Equal(c) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			certs = append(certs, c)
+		}
+	}
+
+	return certs, nil
+}
+
+// pemCertificate converts a Vault response in the requested format to the
+// PEM encoded response every output and the archive are built from.
+func pemCertificate(format string, cert vault.CertResponse) (vault.CertResponse, error) {
+	switch format {
+	case "", config.FormatPEM:
+		return cert, nil
+	case config.FormatPEMBundle:
+		return splitPEMBundle(cert)
+	case config.FormatDER:
+		return derToPEM(cert)
+	default:
+		return cert, fmt.Errorf("Error: certificate format %v not supported", format)
+	}
+}
+
+// splitPEMBundle extracts the certificate from a pem_bundle response, where
+// the certificate field also holds the private key and the issuing CA.
+func splitPEMBundle(cert vault.CertResponse) (vault.CertResponse, error) {
+	var certs []string
+	var key string
+
+	rest := []byte(cert.Data.Certificate)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		encoded := strings.TrimSpace(string(pem.EncodeToMemory(block)))
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, encoded)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			key = encoded
+		}
+	}
+	if len(certs) == 0 {
+		return cert, fmt.Errorf("Error: no certificate found in pem_bundle")
+	}
+
+	cert.Data.Certificate = certs[0]
+	if cert.Data.IssuingCa == "" && len(certs) > 1 {
+		cert.Data.IssuingCa = certs[1]
+	}
+	if cert.Data.PrivateKey == "" {
+		cert.Data.PrivateKey = key
+	}
+
+	return cert, nil
+}
+
+// derToPEM converts a der response, where every field is base64 encoded
+// DER, to PEM.
+func derToPEM(cert vault.CertResponse) (vault.CertResponse, error) {
+	toPEM := func(name, content string) (string, error) {
+		if content == "" {
+			return "", nil
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+		if err != nil {
+			return "", fmt.Errorf("Error decoding %s: %v", name, err)
+		}
+
+		blockType := "CERTIFICATE"
+		if name == "private_key" {
+			if blockType, err = privateKeyBlockType(der); err != nil {
+				return "", err
+			}
+		}
+
+		return strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))), nil
+	}
+
+	var err error
+	if cert.Data.Certificate, err = toPEM("certificate", cert.Data.Certificate); err != nil {
+		return cert, err
+	}
+	if cert.Data.IssuingCa, err = toPEM("issuing_ca", cert.Data.IssuingCa); err != nil {
+		return cert, err
+	}
+	for i, c := range cert.Data.Chain {
+		if cert.Data.Chain[i], err = toPEM("ca_chain", c); err != nil {
+			return cert, err
+		}
+	}
+	// a locally generated private key is already PEM encoded
+	if !strings.HasPrefix(cert.Data.PrivateKey, "-----BEGIN") {
+		if cert.Data.PrivateKey, err = toPEM("private_key", cert.Data.PrivateKey); err != nil {
+			return cert, err
+		}
+	}
+
+	return cert, nil
+}
+
+func privateKeyBlockType(der []byte) (string, error) {
+	if _, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return "PRIVATE KEY", nil
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return "RSA PRIVATE KEY", nil
+	}
+	if _, err := x509.ParseECPrivateKey(der); err == nil {
+		return "EC PRIVATE KEY", nil
+	}
+	return "", fmt.Errorf("Error: unsupported DER private key")
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// runPool calls work for every index from 0 to n-1 with at most workers
+// calls running at once. Once a call returns false the indexes not started
+// yet are skipped.
+func runPool(workers, n int, work func(i int) bool) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	var stopped int32
+	jobs := make(chan int)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if atomic.LoadInt32(&stopped) != 0 {
+					continue
+				}
+				if !work(i) {
+					atomic.StoreInt32(&stopped, 1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n && atomic.LoadInt32(&stopped) == 0; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// keyedMutex serializes the callers locking the same key.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks key and returns the function unlocking it.
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[key] = l
+	}
+	m.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/vdesjardins/cert-monitor/config"
+)
+
+const (
+	defaultReloadTimeout = 5 * time.Minute
+)
+
+// renewedCertificate describes a deployed certificate to the commands run
+// after its deployment.
+type renewedCertificate struct {
+	commonName  string
+	outputFiles []string
+	notAfter    time.Time
+	serial      string
+}
+
+func newRenewedCertificate(certConfig config.CertConfig, cert *x509.Certificate) renewedCertificate {
+	var outputFiles []string
+	for _, o := range certConfig.Output {
+		outputFiles = append(outputFiles, o.Name)
+	}
+
+	return renewedCertificate{
+		commonName:  certConfig.CommonName,
+		outputFiles: outputFiles,
+		notAfter:    cert.NotAfter,
+		serial:      formatSerial(cert),
+	}
+}
+
+// formatSerial formats the certificate serial number the way Vault does
+// (colon separated hexadecimal bytes).
+func formatSerial(cert *x509.Certificate) string {
+	var parts []string
+	for _, b := range cert.SerialNumber.Bytes() {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+// reloadCommand is a reload command shared by one or more renewed
+// certificates. It is run once per check, with the longest timeout of the
+// certificates using it.
+type reloadCommand struct {
+	command string
+	timeout time.Duration
+	certs   []renewedCertificate
+}
+
+// environment exposes the renewed certificates to the command. When a
+// command is shared by several certificates the values are space
+// separated, in the same order for every variable.
+func (r reloadCommand) environment() []string {
+	var commonNames, outputFiles, notAfters, serials []string
+	for _, c := range r.certs {
+		commonNames = append(commonNames, c.commonName)
+		outputFiles = append(outputFiles, c.outputFiles...)
+		notAfters = append(notAfters, c.notAfter.Format(time.RFC3339))
+		serials = append(serials, c.serial)
+	}
+
+	return []string{
+		"CERT_MONITOR_COMMON_NAME=" + strings.Join(commonNames, " "),
+		"CERT_MONITOR_OUTPUT_FILE=" + strings.Join(outputFiles, " "),
+		"CERT_MONITOR_NOT_AFTER=" + strings.Join(notAfters, " "),
+		"CERT_MONITOR_SERIAL=" + strings.Join(serials, " "),
+	}
+}
+
+// reloadQueue collects the reload commands of renewed certificates in the
+// order they were first requested.
+type reloadQueue struct {
+	commands []*reloadCommand
+	index    map[string]*reloadCommand
+}
+
+func (q *reloadQueue) add(certConfig config.CertConfig, cert renewedCertificate) {
+	if q.index == nil {
+		q.index = map[string]*reloadCommand{}
+	}
+
+	timeout := certConfig.ReloadTimeout
+	if timeout == 0 {
+		timeout = defaultReloadTimeout
+	}
+
+	r, ok := q.index[certConfig.ReloadCommand]
+	if !ok {
+		r = &reloadCommand{command: certConfig.ReloadCommand}
+		q.index[certConfig.ReloadCommand] = r
+		q.commands = append(q.commands, r)
+	}
+	if timeout > r.timeout {
+		r.timeout = timeout
+	}
+	r.certs = append(r.certs, cert)
+}
+
+// run executes every queued command and reports all the failures. The
+// certificates are already deployed, so the commands run even when the
+// process is stopping, each one bounded by its timeout: the next start
+// would not reload a certificate that is not due for renewal.
+func (q *reloadQueue) run() error {
+	var failed []string
+
+	for _, r := range q.commands {
+		if err := restartService(context.Background(), *r); err != nil {
+			log.Println(err)
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Error: %d reload command(s) failed: %v", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func restartService(ctx context.Context, r reloadCommand) error {
+	if r.command == "" {
+		log.Printf("No reload command specified. Skipping.\n")
+		return nil
+	}
+
+	err := runCommand(ctx, r.command, r.timeout, r.environment())
+	recordReload(err)
+	if err != nil {
+		return fmt.Errorf("Error executing reload command `%v': %v", r.command, err)
+	}
+	return nil
+}
+
+// runCommand executes command with bash, adding env to the daemon
+// environment. The command and the processes it started are killed when
+// timeout expires or ctx is cancelled.
+func runCommand(ctx context.Context, command string, timeout time.Duration, env []string) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("not run: %v", ctx.Err())
+	}
+
+	log.Printf("Executing command `%v'\n", command)
+
+	cmd := exec.Command("/bin/bash", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	setProcessGroup(cmd)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		killProcessGroup(cmd)
+		<-done
+		err = fmt.Errorf("timed out after %v", timeout)
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		err = fmt.Errorf("interrupted: %v", ctx.Err())
+	}
+
+	if stdout.Len() > 0 {
+		log.Printf("Output: %q\n", stdout.String())
+	}
+	if stderr.Len() > 0 {
+		log.Printf("Error output: %q\n", stderr.String())
+	}
+
+	if err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+	return nil
+}
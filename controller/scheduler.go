@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/vdesjardins/cert-monitor/config"
+)
+
+// nextCheck returns when ExecLoop wakes up next: the earliest renewal time
+// or failure retry of the certificates after now, at the latest the rescan
+// of the configurations one check interval after now.
+func nextCheck(cfg *config.MainConfig, files []string, now time.Time) time.Time {
+	next := now.Add(cfg.Interval())
+
+	for _, f := range files {
+		certConfig, err := cfg.LoadCertConfig(f)
+		if err != nil {
+			// invalid configurations are loaded again at the rescan
+			continue
+		}
+
+		cert, err := certConfig.LoadCachedCertificate()
+		if err != nil {
+			// missing certificates failed to renew and are retried by
+			// renewalBackoff
+			continue
+		}
+
+		if renewAfter := certConfig.RenewAfter(cert); renewAfter.After(now) && renewAfter.Before(next) {
+			next = renewAfter
+		}
+	}
+
+	if retry, ok := renewalBackoff.nextRetry(now); ok && retry.Before(next) {
+		next = retry
+	}
+
+	return next
+}
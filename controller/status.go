@@ -0,0 +1,226 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vdesjardins/cert-monitor/config"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	StatusFormatTable = "table"
+	StatusFormatJSON  = "json"
+	StatusFormatYAML  = "yaml"
+
+	stateOK          = "ok"
+	stateRenewDue    = "renew-due"
+	stateExpired     = "expired"
+	stateMissing     = "missing"
+	stateConfigError = "config-error"
+)
+
+// certificateStatus describes a certificate configuration and the
+// certificate currently deployed for it.
+type certificateStatus struct {
+	Config        string   `json:"config" yaml:"config"`
+	CommonName    string   `json:"commonName,omitempty" yaml:"commonName,omitempty"`
+	SANs          []string `json:"sans,omitempty" yaml:"sans,omitempty"`
+	Serial        string   `json:"serial,omitempty" yaml:"serial,omitempty"`
+	Issuer        string   `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	KeyType       string   `json:"keyType,omitempty" yaml:"keyType,omitempty"`
+	KeyBits       int      `json:"keyBits,omitempty" yaml:"keyBits,omitempty"`
+	TTL           string   `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	RenewTTL      string   `json:"renewTtl,omitempty" yaml:"renewTtl,omitempty"`
+	RenewBefore   string   `json:"renewBefore,omitempty" yaml:"renewBefore,omitempty"`
+	ShortenedTTL  bool     `json:"shortenedTtl,omitempty" yaml:"shortenedTtl,omitempty"`
+	NotBefore     string   `json:"notBefore,omitempty" yaml:"notBefore,omitempty"`
+	RenewAfter    string   `json:"renewAfter,omitempty" yaml:"renewAfter,omitempty"`
+	RenewJitter   string   `json:"renewJitter,omitempty" yaml:"renewJitter,omitempty"`
+	NotAfter      string   `json:"notAfter,omitempty" yaml:"notAfter,omitempty"`
+	DaysRemaining *int     `json:"daysRemaining,omitempty" yaml:"daysRemaining,omitempty"`
+	State         string   `json:"state" yaml:"state"`
+	Error         string   `json:"error,omitempty" yaml:"error,omitempty"`
+
+	notAfter time.Time
+}
+
+func PrintStatus(configPath string, format string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
+
+	files, err := cfg.ResolveConfigDirs()
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
+
+	if err := writeStatus(os.Stdout, format, loadStatus(cfg, files, time.Now())); err != nil {
+		log.Printf("%v", err)
+		return err
+	}
+
+	return nil
+}
+
+// loadStatus returns the status of every certificate configuration as of
+// now.
+func loadStatus(cfg *config.MainConfig, files []string, now time.Time) []certificateStatus {
+	var statuses []certificateStatus
+
+	for _, f := range files {
+		status := certificateStatus{Config: f}
+
+		c, err := cfg.LoadCertConfig(f)
+		if err != nil {
+			status.State = stateConfigError
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			continue
+		}
+		status.CommonName = c.CommonName
+		if c.TTL != 0 {
+			status.TTL = c.TTL.String()
+		}
+		if c.RenewBefore != 0 {
+			status.RenewBefore = c.RenewBefore.String()
+		} else {
+			status.RenewTTL = c.RenewTTL.String()
+		}
+
+		cert, err := c.LoadCachedCertificate()
+		if err != nil {
+			status.State = stateMissing
+			status.Error = err.Error()
+			statuses = append(statuses, status)
+			continue
+		}
+
+		status.SANs = certificateSANs(cert)
+		status.Serial = formatSerial(cert)
+		status.Issuer = cert.Issuer.String()
+		status.KeyType, status.KeyBits = certificateKeyType(cert)
+		status.NotBefore = cert.NotBefore.Format(time.RFC3339)
+		status.RenewAfter = c.RenewAfter(cert).Format(time.RFC3339)
+		if jitter := c.RenewJitter(cert); jitter > 0 {
+			status.RenewJitter = jitter.Truncate(time.Second).String()
+		}
+		status.ShortenedTTL = c.ShortenedTTL(cert)
+		status.NotAfter = cert.NotAfter.Format(time.RFC3339)
+		status.notAfter = cert.NotAfter
+
+		days := daysRemaining(cert.NotAfter.Sub(now))
+		status.DaysRemaining = &days
+
+		switch {
+		case now.After(cert.NotAfter):
+			status.State = stateExpired
+		case now.After(c.RenewAfter(cert)):
+			status.State = stateRenewDue
+		default:
+			status.State = stateOK
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func writeStatus(w io.Writer, format string, statuses []certificateStatus) error {
+	switch format {
+	case "", StatusFormatTable:
+		return writeStatusTable(w, statuses)
+	case StatusFormatJSON:
+		if statuses == nil {
+			statuses = []certificateStatus{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	case StatusFormatYAML:
+		content, err := yaml.Marshal(statuses)
+		if err != nil {
+			return fmt.Errorf("Error marshalling status: %v", err)
+		}
+		_, err = w.Write(content)
+		return err
+	default:
+		return fmt.Errorf("Error: status format %v is invalid. Valid values are: %v, %v, %v", format, StatusFormatTable, StatusFormatJSON, StatusFormatYAML)
+	}
+}
+
+func writeStatusTable(w io.Writer, statuses []certificateStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+
+	fmt.Fprintln(tw, "Configuration\tTTL\tRenewTTL\tNot Before\tRenew After\tNot After\tState")
+	format := "%v\t%v\t%v\t%v\t%v\t%v\t%v\n"
+
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	for _, s := range statuses {
+		renew := s.RenewTTL
+		if s.RenewBefore != "" {
+			renew = s.RenewBefore
+		}
+		fmt.Fprintf(tw, format, s.Config, dash(s.TTL), dash(renew),
+			dash(s.NotBefore), dash(s.RenewAfter), dash(s.NotAfter), s.State)
+	}
+
+	return tw.Flush()
+}
+
+// daysRemaining converts a remaining lifetime to whole days.
+func daysRemaining(d time.Duration) int {
+	return int(math.Floor(d.Hours() / 24))
+}
+
+// certificateSANs returns every subject alternative name of the
+// certificate.
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+
+	return sans
+}
+
+// certificateKeyType returns the key type of the certificate with the
+// names used by keyType.
+func certificateKeyType(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return config.KeyTypeRSA, key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return config.KeyTypeEC, key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return config.KeyTypeEd25519, 0
+	default:
+		return "unknown", 0
+	}
+}
@@ -0,0 +1,233 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/vdesjardins/cert-monitor/config"
+	"github.com/vdesjardins/cert-monitor/vault"
+)
+
+// vaultClientKey identifies the Vault clients that can be shared by
+// several certificates.
+type vaultClientKey struct {
+	namespace string
+	certPath  string
+	signPath  string
+}
+
+// vaultClients keeps the Vault clients, and the token they share, from one
+// check to the next while the Vault configuration is unchanged.
+var vaultClients struct {
+	sync.Mutex
+	config  config.VaultConfig
+	clients map[vaultClientKey]*vault.Client
+	tokens  *vault.TokenCache
+}
+
+// getVaultClient returns the client for the PKI role and namespace of the
+// certificate, reusing the one of a previous certificate when they match.
+func getVaultClient(certConfig config.CertConfig) (*vault.Client, error) {
+	mainConfig := *certConfig.MainConfig
+
+	certPath, signPath, err := certVaultPaths(mainConfig.Vault, certConfig.Vault)
+	if err != nil {
+		return nil, err
+	}
+	key := vaultClientKey{
+		namespace: mainConfig.Vault.Namespace,
+		certPath:  certPath,
+		signPath:  signPath,
+	}
+	if certConfig.Vault.Namespace != "" {
+		key.namespace = certConfig.Vault.Namespace
+	}
+
+	vaultClients.Lock()
+	defer vaultClients.Unlock()
+
+	if vaultClients.clients == nil || !reflect.DeepEqual(vaultClients.config, mainConfig.Vault) {
+		vaultClients.config = mainConfig.Vault
+		vaultClients.clients = map[vaultClientKey]*vault.Client{}
+		vaultClients.tokens = &vault.TokenCache{}
+	}
+	if client, ok := vaultClients.clients[key]; ok {
+		return client, nil
+	}
+
+	client, err := initVaultClient(mainConfig, key, vaultClients.tokens)
+	if err != nil {
+		return nil, err
+	}
+	vaultClients.clients[key] = client
+
+	return client, nil
+}
+
+// initVaultClient creates the client of a PKI role and namespace. Every
+// client logs in to the auth namespace of the main configuration, never to
+// the namespace of a certificate, and shares tokens.
+func initVaultClient(mainConfig config.MainConfig, key vaultClientKey, tokens *vault.TokenCache) (*vault.Client, error) {
+	var baseUrls []url.URL
+	for _, address := range mainConfig.Vault.Addresses() {
+		baseUrl, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse Vault base URL %v: %v", address, err)
+		}
+		baseUrls = append(baseUrls, *baseUrl)
+	}
+	certPath, err := url.Parse(key.certPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse Vault certificate URL path %v: %v", key.certPath, err)
+	}
+	signPath, err := url.Parse(key.signPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse Vault sign URL path %v: %v", key.signPath, err)
+	}
+	loginPath, err := url.Parse(mainConfig.Vault.LoginPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse Vault login URL path %v: %v", mainConfig.Vault.LoginPath, err)
+	}
+
+	auth, err := vaultAuthMethod(mainConfig.Vault)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := mainConfig.Vault.TLS
+	httpClient, err := vault.NewHTTPClient(vault.TLSConfig{
+		CACert:             tlsConfig.CACert,
+		ClientCert:         tlsConfig.ClientCert,
+		ClientKey:          tlsConfig.ClientKey,
+		ServerName:         tlsConfig.ServerName,
+		MinVersion:         tlsConfig.MinVersion,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}, mainConfig.Vault.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to configure the Vault connection: %v", err)
+	}
+
+	return &vault.Client{
+		BaseUrl:       baseUrls[0],
+		BaseUrls:      baseUrls,
+		CertPath:      *certPath,
+		SignPath:      *signPath,
+		LoginPath:     *loginPath,
+		RoleId:        mainConfig.Vault.RoleId,
+		SecretId:      mainConfig.Vault.SecretId,
+		Namespace:     key.namespace,
+		AuthNamespace: authNamespace(mainConfig.Vault),
+		Tokens:        tokens,
+		Auth:          auth,
+		HTTPClient:    httpClient,
+		Retry:         vaultRetryPolicy(mainConfig.Vault.Retry),
+		Observe:       recordVaultRequest,
+	}, nil
+}
+
+// authNamespace returns the namespace the auth method is mounted in,
+// vault.auth.namespace or else vault.namespace.
+func authNamespace(vaultConfig config.VaultConfig) string {
+	if vaultConfig.Auth.Namespace != "" {
+		return vaultConfig.Auth.Namespace
+	}
+	return vaultConfig.Namespace
+}
+
+// vaultRetryPolicy returns the retry policy of vault.retry, the fields not
+// set keeping their default.
+func vaultRetryPolicy(retryConfig config.VaultRetryConfig) *vault.RetryPolicy {
+	policy := vault.DefaultRetryPolicy
+
+	if retryConfig.MaxAttempts != 0 {
+		policy.MaxAttempts = retryConfig.MaxAttempts
+	}
+	if retryConfig.BaseBackoff != 0 {
+		policy.BaseBackoff = retryConfig.BaseBackoff
+	}
+	if retryConfig.MaxBackoff != 0 {
+		policy.MaxBackoff = retryConfig.MaxBackoff
+	}
+	if retryConfig.Jitter != 0 {
+		policy.Jitter = retryConfig.Jitter
+	}
+	if len(retryConfig.RetryableStatusCodes) > 0 {
+		policy.RetryableStatusCodes = retryConfig.RetryableStatusCodes
+	}
+
+	return &policy
+}
+
+// vaultAuthMethod returns the authentication method selected by
+// vault.auth.method, nil meaning AppRole.
+func vaultAuthMethod(vaultConfig config.VaultConfig) (vault.AuthMethod, error) {
+	authConfig := vaultConfig.Auth
+
+	var path url.URL
+	if authConfig.Path != "" {
+		p, err := url.Parse(authConfig.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse Vault auth URL path %v: %v", authConfig.Path, err)
+		}
+		path = *p
+	}
+
+	switch authConfig.Method {
+	case "", config.AuthMethodAppRole:
+		return nil, nil
+	case config.AuthMethodToken:
+		return &vault.TokenAuth{Token: authConfig.Token, File: authConfig.TokenFile}, nil
+	case config.AuthMethodKubernetes:
+		return &vault.KubernetesAuth{Path: path, Role: authConfig.Role, JWTFile: authConfig.JWTFile}, nil
+	case config.AuthMethodCert:
+		return &vault.CertAuth{Path: path, Name: authConfig.Role, CertFile: authConfig.CertFile, KeyFile: authConfig.KeyFile}, nil
+	default:
+		return nil, fmt.Errorf("Error: vault.auth.method %v is not supported", authConfig.Method)
+	}
+}
+
+// certVaultPaths returns the issue and sign paths of a certificate. The
+// certificate can set its own certPath, or only override the PKI mount or
+// the role of the main certPath (/v1/<pkiMount>/issue/<role>).
+func certVaultPaths(vaultConfig config.VaultConfig, certVault config.CertVaultConfig) (string, string, error) {
+	if certVault.CertPath != "" {
+		signPath := certVault.SignPath
+		if signPath == "" {
+			signPath = strings.Replace(certVault.CertPath, "/issue/", "/sign/", 1)
+		}
+		return certVault.CertPath, signPath, nil
+	}
+
+	if certVault.PkiMount == "" && certVault.Role == "" {
+		return vaultConfig.CertPath, vaultSignPath(vaultConfig), nil
+	}
+
+	i := strings.LastIndex(vaultConfig.CertPath, "/issue/")
+	if i < 0 {
+		return "", "", fmt.Errorf("Error: vault.certPath %v is not an issue path (/v1/<pkiMount>/issue/<role>); set vault.certPath in the certificate configuration", vaultConfig.CertPath)
+	}
+	mount := vaultConfig.CertPath[:i]
+	role := vaultConfig.CertPath[i+len("/issue/"):]
+
+	if certVault.PkiMount != "" {
+		mount = "/v1/" + strings.Trim(certVault.PkiMount, "/")
+	}
+	if certVault.Role != "" {
+		role = certVault.Role
+	}
+
+	return mount + "/issue/" + role, mount + "/sign/" + role, nil
+}
+
+// vaultSignPath returns the configured sign path or derives it from the
+// issue path (pki/issue/<role> -> pki/sign/<role>).
+func vaultSignPath(vaultConfig config.VaultConfig) string {
+	if vaultConfig.SignPath != "" {
+		return vaultConfig.SignPath
+	}
+
+	return strings.Replace(vaultConfig.CertPath, "/issue/", "/sign/", 1)
+}
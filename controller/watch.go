@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vdesjardins/cert-monitor/config"
+)
+
+// watchSettleDelay is the wait between a change of a certificate
+// configuration and its reload.
+const watchSettleDelay = time.Second
+
+// configWatcher signals the changes of the certificate configurations
+// while watch is enabled, following the include paths of the main
+// configuration when they are reloaded.
+type configWatcher struct {
+	changes  chan struct{}
+	patterns []string
+	closer   io.Closer
+}
+
+func newConfigWatcher() *configWatcher {
+	return &configWatcher{changes: make(chan struct{}, 1)}
+}
+
+// update starts, restarts or stops watching according to cfg.
+func (w *configWatcher) update(cfg *config.MainConfig) {
+	if !cfg.Watch {
+		w.stop()
+		return
+	}
+	if w.closer != nil && reflect.DeepEqual(w.patterns, cfg.IncludePaths) {
+		return
+	}
+
+	w.stop()
+	closer, err := watchIncludePaths(cfg.IncludePaths, w.changes)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	w.closer, w.patterns = closer, cfg.IncludePaths
+	log.Printf("Watching %v for changes", strings.Join(cfg.IncludePaths, ", "))
+}
+
+func (w *configWatcher) stop() {
+	if w.closer != nil {
+		w.closer.Close()
+		w.closer, w.patterns = nil, nil
+	}
+}
+
+// validCertConfigs keeps the last valid configuration of each certificate
+// so an invalid edit does not interrupt the renewal of a certificate.
+var validCertConfigs struct {
+	sync.Mutex
+	configs map[string]config.CertConfig
+}
+
+func rememberCertConfig(file string, certConfig config.CertConfig) {
+	validCertConfigs.Lock()
+	defer validCertConfigs.Unlock()
+
+	if validCertConfigs.configs == nil {
+		validCertConfigs.configs = map[string]config.CertConfig{}
+	}
+	validCertConfigs.configs[file] = certConfig
+}
+
+// lastValidCertConfig returns the last valid configuration loaded from
+// file, attached to the current main configuration.
+func lastValidCertConfig(cfg *config.MainConfig, file string) (config.CertConfig, bool) {
+	validCertConfigs.Lock()
+	defer validCertConfigs.Unlock()
+
+	certConfig, ok := validCertConfigs.configs[file]
+	if ok {
+		mainConfig := *cfg
+		certConfig.MainConfig = &mainConfig
+	}
+	return certConfig, ok
+}
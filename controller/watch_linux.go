@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package controller
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+	syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// watchIncludePaths watches the directories of the include path globs with
+// inotify and signals changes when a file matching one of the globs is
+// created, written, moved or removed.
+func watchIncludePaths(patterns []string, changes chan<- struct{}) (io.Closer, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing inotify: %v", err)
+	}
+	// a non blocking file is read through the runtime poller, so Close
+	// interrupts the pending read
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	dirs := map[int32]string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Dir(pattern))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error reading glob path %v: %v", pattern, err)
+		}
+		for _, dir := range matches {
+			wd, err := syscall.InotifyAddWatch(fd, dir, watchMask)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("Error watching %v: %v", dir, err)
+			}
+			dirs[int32(wd)] = dir
+		}
+	}
+
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+				offset = nameStart + int(event.Len)
+
+				if matchesAny(patterns, filepath.Join(dirs[event.Wd], name)) {
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+
+	return file, nil
+}
+
+func matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchIncludePaths(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	changes := make(chan struct{}, 1)
+	closer, err := watchIncludePaths([]string{filepath.Join(dir, "*.yml")}, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Errorf("A file not matching the include path should be ignored")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "new.yml"), []byte("commonName: new.domain.tld\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Errorf("The new certificate configuration was not detected")
+	}
+
+	if err := closer.Close(); err != nil {
+		t.Errorf("Error closing the watcher: %v", err)
+	}
+}
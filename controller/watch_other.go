@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package controller
+
+import (
+	"fmt"
+	"io"
+)
+
+func watchIncludePaths(patterns []string, changes chan<- struct{}) (io.Closer, error) {
+	return nil, fmt.Errorf("Error: watching the include paths is only supported on Linux")
+}
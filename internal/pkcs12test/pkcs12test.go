@@ -0,0 +1,293 @@
+// Package pkcs12test decodes the PKCS#12 archives written by the keystore
+// package so the tests of other packages can check their content. It only
+// supports what keystore.EncodePKCS12 produces and is not meant for
+// production use.
+package pkcs12test
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"unicode/utf16"
+)
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidFriendlyName             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes []attribute   `asn1:"set,optional"`
+}
+
+type attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	AlgorithmIdentifier pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type macData struct {
+	Mac struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+// Decode returns the private key, its certificate, the CA chain and the
+// friendly name of the key entry of a password protected archive.
+func Decode(pfxData []byte, password string) (crypto.PrivateKey, *x509.Certificate, []*x509.Certificate, string, error) {
+	encodedPassword := bmpString(password)
+
+	var pfx pfxPdu
+	if _, err := asn1.Unmarshal(pfxData, &pfx); err != nil {
+		return nil, nil, nil, "", fmt.Errorf("decoding PFX: %v", err)
+	}
+	var authenticatedSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+		return nil, nil, nil, "", fmt.Errorf("decoding authenticated safe: %v", err)
+	}
+
+	macKey := pbkdf(encodedPassword, pfx.MacData.MacSalt, 3, pfx.MacData.Iterations, sha1.Size)
+	mac := hmac.New(sha1.New, macKey)
+	mac.Write(authenticatedSafe)
+	if !hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest) {
+		return nil, nil, nil, "", fmt.Errorf("MAC verification failed")
+	}
+
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authenticatedSafe, &contents); err != nil {
+		return nil, nil, nil, "", fmt.Errorf("decoding content infos: %v", err)
+	}
+
+	var key crypto.PrivateKey
+	var cert *x509.Certificate
+	var caCerts []*x509.Certificate
+	var name string
+	for _, ci := range contents {
+		var safeContents []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &safeContents); err != nil {
+				return nil, nil, nil, "", fmt.Errorf("decoding data content: %v", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, nil, "", fmt.Errorf("decoding encrypted data: %v", err)
+			}
+			info := ed.EncryptedContentInfo
+			plaintext, err := pbeDecrypt(info.ContentEncryptionAlgorithm, info.EncryptedContent, encodedPassword)
+			if err != nil {
+				return nil, nil, nil, "", err
+			}
+			safeContents = plaintext
+		default:
+			return nil, nil, nil, "", fmt.Errorf("unexpected content type %v", ci.ContentType)
+		}
+
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(safeContents, &bags); err != nil {
+			return nil, nil, nil, "", fmt.Errorf("decoding safe contents: %v", err)
+		}
+
+		for _, bag := range bags {
+			switch {
+			case bag.Id.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, nil, "", fmt.Errorf("decoding certificate bag: %v", err)
+				}
+				c, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, nil, "", err
+				}
+				// only the certificate of the key has a local key ID
+				if findAttribute(bag, oidLocalKeyID) != nil {
+					cert = c
+				} else {
+					caCerts = append(caCerts, c)
+				}
+			case bag.Id.Equal(oidPKCS8ShroudedKeyBag):
+				var info encryptedPrivateKeyInfo
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &info); err != nil {
+					return nil, nil, nil, "", fmt.Errorf("decoding key bag: %v", err)
+				}
+				pkcs8, err := pbeDecrypt(info.AlgorithmIdentifier, info.EncryptedData, encodedPassword)
+				if err != nil {
+					return nil, nil, nil, "", err
+				}
+				if key, err = x509.ParsePKCS8PrivateKey(pkcs8); err != nil {
+					return nil, nil, nil, "", err
+				}
+				if name, err = friendlyName(bag); err != nil {
+					return nil, nil, nil, "", err
+				}
+			default:
+				return nil, nil, nil, "", fmt.Errorf("unexpected bag %v", bag.Id)
+			}
+		}
+	}
+
+	if key == nil || cert == nil {
+		return nil, nil, nil, "", fmt.Errorf("archive has no key entry")
+	}
+	return key, cert, caCerts, name, nil
+}
+
+func pbeDecrypt(algorithm pkix.AlgorithmIdentifier, data, password []byte) ([]byte, error) {
+	var params pbeParams
+	if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("decoding PBE parameters: %v", err)
+	}
+	if len(data) == 0 || len(data)%des.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted data length %d", len(data))
+	}
+
+	key := pbkdf(password, params.Salt, 1, params.Iterations, 24)
+	iv := pbkdf(password, params.Salt, 2, params.Iterations, des.BlockSize)
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding < 1 || padding > des.BlockSize {
+		return nil, fmt.Errorf("invalid padding, wrong password?")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+func findAttribute(bag safeBag, id asn1.ObjectIdentifier) *attribute {
+	for i := range bag.Attributes {
+		if bag.Attributes[i].Id.Equal(id) {
+			return &bag.Attributes[i]
+		}
+	}
+	return nil
+}
+
+func friendlyName(bag safeBag) (string, error) {
+	attr := findAttribute(bag, oidFriendlyName)
+	if attr == nil {
+		return "", nil
+	}
+	var value asn1.RawValue
+	if _, err := asn1.Unmarshal(attr.Value.Bytes, &value); err != nil {
+		return "", fmt.Errorf("decoding friendly name: %v", err)
+	}
+	u := make([]uint16, len(value.Bytes)/2)
+	for i := range u {
+		u[i] = uint16(value.Bytes[2*i])<<8 | uint16(value.Bytes[2*i+1])
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+// bmpString encodes a password as big-endian UTF-16 with a trailing NUL.
+func bmpString(s string) []byte {
+	var out []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0)
+}
+
+// pbkdf is the PKCS#12 key derivation function with SHA-1 (RFC 7292
+// appendix B.2).
+func pbkdf(password, salt []byte, id byte, iterations, size int) []byte {
+	const v = 64
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+	i := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+
+		b := make([]byte, v)
+		for k := range b {
+			b[k] = a[k%len(a)]
+		}
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
@@ -0,0 +1,207 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	jksMagic   = 0xfeedfeed
+	jksVersion = 2
+
+	jksPrivateKeyTag  = 1
+	jksTrustedCertTag = 2
+
+	jksCertType = "X.509"
+	// jksWhitener is mixed into the keystore integrity digest by the Sun
+	// JKS implementation.
+	jksWhitener = "Mighty Aphrodite"
+)
+
+// oidJKSKeyProtector identifies the proprietary Sun key protection
+// algorithm used for JKS private key entries.
+var oidJKSKeyProtector = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 42, 2, 17, 1, 1}
+
+// TrustStoreEntry is a trusted certificate stored under Alias.
+type TrustStoreEntry struct {
+	Alias       string
+	Certificate *x509.Certificate
+}
+
+// EncodeJKS produces a Java KeyStore with a single private key entry named
+// alias holding the private key, its certificate and the CA chain. The key
+// entry and the keystore share the same password.
+func EncodeJKS(privateKey crypto.PrivateKey, certificate *x509.Certificate, caCerts []*x509.Certificate, alias, password string) ([]byte, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode private key: %v", err)
+	}
+
+	protectedKey, err := jksProtectKey(pkcs8, password)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	jksWriteHeader(buf, 1)
+
+	writeUint32(buf, jksPrivateKeyTag)
+	if err := writeJavaUTF(buf, strings.ToLower(alias)); err != nil {
+		return nil, err
+	}
+	writeTimestamp(buf, time.Now())
+	writeUint32(buf, uint32(len(protectedKey)))
+	buf.Write(protectedKey)
+
+	chain := append([]*x509.Certificate{certificate}, caCerts...)
+	writeUint32(buf, uint32(len(chain)))
+	for _, cert := range chain {
+		jksWriteCertificate(buf, cert)
+	}
+
+	return jksSign(buf, password), nil
+}
+
+// EncodeJKSTrustStore produces a Java KeyStore containing only trusted
+// certificate entries.
+func EncodeJKSTrustStore(entries []TrustStoreEntry, password string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	jksWriteHeader(buf, len(entries))
+
+	now := time.Now()
+	for _, entry := range entries {
+		writeUint32(buf, jksTrustedCertTag)
+		if err := writeJavaUTF(buf, strings.ToLower(entry.Alias)); err != nil {
+			return nil, err
+		}
+		writeTimestamp(buf, now)
+		jksWriteCertificate(buf, entry.Certificate)
+	}
+
+	return jksSign(buf, password), nil
+}
+
+func jksWriteHeader(buf *bytes.Buffer, count int) {
+	writeUint32(buf, jksMagic)
+	writeUint32(buf, jksVersion)
+	writeUint32(buf, uint32(count))
+}
+
+func jksWriteCertificate(buf *bytes.Buffer, cert *x509.Certificate) {
+	// the certificate type is plain ASCII; it can't fail
+	writeJavaUTF(buf, jksCertType)
+	writeUint32(buf, uint32(len(cert.Raw)))
+	buf.Write(cert.Raw)
+}
+
+// jksSign appends the keystore integrity digest to buf and returns the
+// resulting keystore.
+func jksSign(buf *bytes.Buffer, password string) []byte {
+	h := sha1.New()
+	h.Write(jksPassword(password))
+	h.Write([]byte(jksWhitener))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	return buf.Bytes()
+}
+
+// jksProtectKey encrypts a PKCS#8 private key with the Sun KeyProtector
+// algorithm: the key is XORed with a SHA-1 based key stream derived from
+// the password and a random salt, followed by a SHA-1 integrity check.
+func jksProtectKey(pkcs8 []byte, password string) ([]byte, error) {
+	passwd := jksPassword(password)
+
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %v", err)
+	}
+
+	encrypted := make([]byte, len(pkcs8))
+	digest := salt
+	for i := 0; i < len(pkcs8); i += sha1.Size {
+		h := sha1.New()
+		h.Write(passwd)
+		h.Write(digest)
+		digest = h.Sum(nil)
+		for j := 0; j < sha1.Size && i+j < len(pkcs8); j++ {
+			encrypted[i+j] = pkcs8[i+j] ^ digest[j]
+		}
+	}
+
+	h := sha1.New()
+	h.Write(passwd)
+	h.Write(pkcs8)
+
+	protected := append(append(salt, encrypted...), h.Sum(nil)...)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		AlgorithmIdentifier: pkix.AlgorithmIdentifier{Algorithm: oidJKSKeyProtector, Parameters: asn1.NullRawValue},
+		EncryptedData:       protected,
+	})
+}
+
+// jksPassword encodes the password as big-endian UTF-16 without terminator.
+func jksPassword(password string) []byte {
+	var out []byte
+	for _, r := range password {
+		if r > 0xffff {
+			r1, r2 := utf16.EncodeRune(r)
+			out = append(out, byte(r1>>8), byte(r1), byte(r2>>8), byte(r2))
+			continue
+		}
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return out
+}
+
+// writeJavaUTF writes s in the modified UTF-8 encoding of
+// java.io.DataOutput.writeUTF.
+func writeJavaUTF(buf *bytes.Buffer, s string) error {
+	var encoded []byte
+	appendChar := func(c rune) {
+		switch {
+		case c != 0 && c < 0x80:
+			encoded = append(encoded, byte(c))
+		case c < 0x800:
+			encoded = append(encoded, byte(0xc0|c>>6), byte(0x80|c&0x3f))
+		default:
+			encoded = append(encoded, byte(0xe0|c>>12), byte(0x80|(c>>6)&0x3f), byte(0x80|c&0x3f))
+		}
+	}
+	for _, r := range s {
+		if r > 0xffff {
+			r1, r2 := utf16.EncodeRune(r)
+			appendChar(r1)
+			appendChar(r2)
+			continue
+		}
+		appendChar(r)
+	}
+
+	if len(encoded) > 0xffff {
+		return fmt.Errorf("jks: string too long: %d bytes", len(encoded))
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(len(encoded)))
+	buf.Write(encoded)
+	return nil
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func writeTimestamp(buf *bytes.Buffer, t time.Time) {
+	binary.Write(buf, binary.BigEndian, t.UnixNano()/int64(time.Millisecond))
+}
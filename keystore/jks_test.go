@@ -0,0 +1,208 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+type jksEntry struct {
+	tag   uint32
+	alias string
+	key   []byte
+	certs []*x509.Certificate
+}
+
+func TestEncodeJKS(t *testing.T) {
+	key, cert, ca := testCertificates(t)
+
+	data, err := EncodeJKS(key, cert, []*x509.Certificate{ca}, "Tomcat", "changeit")
+	if err != nil {
+		t.Fatalf("Error encoding JKS: %v", err)
+	}
+
+	entries := decodeJKS(t, data, "changeit")
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.tag != jksPrivateKeyTag || entry.alias != "tomcat" {
+		t.Errorf("Expected private key entry with alias tomcat, got tag %d alias %q", entry.tag, entry.alias)
+	}
+	if len(entry.certs) != 2 || !entry.certs[0].Equal(cert) || !entry.certs[1].Equal(ca) {
+		t.Errorf("Expected certificate followed by CA in the key entry chain")
+	}
+
+	decodedKey, err := x509.ParsePKCS8PrivateKey(jksRecoverKey(t, entry.key, "changeit"))
+	if err != nil {
+		t.Fatalf("Error parsing recovered private key: %v", err)
+	}
+	if ecKey, ok := decodedKey.(*ecdsa.PrivateKey); !ok || ecKey.D.Cmp(key.D) != 0 {
+		t.Errorf("Recovered private key does not match")
+	}
+}
+
+func TestEncodeJKSTrustStore(t *testing.T) {
+	_, cert, ca := testCertificates(t)
+
+	data, err := EncodeJKSTrustStore([]TrustStoreEntry{{"root", ca}, {"intermediate", cert}}, "changeit")
+	if err != nil {
+		t.Fatalf("Error encoding JKS truststore: %v", err)
+	}
+
+	entries := decodeJKS(t, data, "changeit")
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	for i, alias := range []string{"root", "intermediate"} {
+		if entries[i].tag != jksTrustedCertTag || entries[i].alias != alias {
+			t.Errorf("Expected trusted certificate entry %q, got tag %d alias %q", alias, entries[i].tag, entries[i].alias)
+		}
+	}
+	if !entries[0].certs[0].Equal(ca) {
+		t.Errorf("Unexpected certificate in trusted entry")
+	}
+}
+
+func TestEncodeJKSWrongPassword(t *testing.T) {
+	_, _, ca := testCertificates(t)
+
+	data, err := EncodeJKSTrustStore([]TrustStoreEntry{{"root", ca}}, "changeit")
+	if err != nil {
+		t.Fatalf("Error encoding JKS truststore: %v", err)
+	}
+
+	if jksVerify(data, "wrong") {
+		t.Errorf("Keystore digest must not verify with the wrong password")
+	}
+}
+
+func jksVerify(data []byte, password string) bool {
+	content, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+
+	h := sha1.New()
+	h.Write(jksPassword(password))
+	h.Write([]byte(jksWhitener))
+	h.Write(content)
+
+	return bytes.Equal(h.Sum(nil), digest)
+}
+
+func decodeJKS(t *testing.T, data []byte, password string) []jksEntry {
+	if !jksVerify(data, password) {
+		t.Fatalf("Keystore digest verification failed")
+	}
+
+	r := bytes.NewReader(data[:len(data)-sha1.Size])
+	var magic, version, count uint32
+	readBinary(t, r, &magic)
+	readBinary(t, r, &version)
+	readBinary(t, r, &count)
+	if magic != jksMagic || version != jksVersion {
+		t.Fatalf("Invalid JKS header %x version %d", magic, version)
+	}
+
+	var entries []jksEntry
+	for i := uint32(0); i < count; i++ {
+		var entry jksEntry
+		var timestamp int64
+		readBinary(t, r, &entry.tag)
+		entry.alias = readJavaUTF(t, r)
+		readBinary(t, r, &timestamp)
+
+		switch entry.tag {
+		case jksPrivateKeyTag:
+			entry.key = readBlock(t, r)
+			var chainLen uint32
+			readBinary(t, r, &chainLen)
+			for j := uint32(0); j < chainLen; j++ {
+				entry.certs = append(entry.certs, readJKSCertificate(t, r))
+			}
+		case jksTrustedCertTag:
+			entry.certs = append(entry.certs, readJKSCertificate(t, r))
+		default:
+			t.Fatalf("Unknown entry tag %d", entry.tag)
+		}
+		entries = append(entries, entry)
+	}
+
+	if r.Len() != 0 {
+		t.Errorf("Unexpected %d trailing bytes", r.Len())
+	}
+	return entries
+}
+
+func jksRecoverKey(t *testing.T, protectedKey []byte, password string) []byte {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(protectedKey, &info); err != nil {
+		t.Fatalf("Error decoding protected key: %v", err)
+	}
+	if !info.AlgorithmIdentifier.Algorithm.Equal(oidJKSKeyProtector) {
+		t.Fatalf("Unexpected key protection algorithm %v", info.AlgorithmIdentifier.Algorithm)
+	}
+
+	data := info.EncryptedData
+	salt := data[:sha1.Size]
+	encrypted := data[sha1.Size : len(data)-sha1.Size]
+	check := data[len(data)-sha1.Size:]
+	passwd := jksPassword(password)
+
+	plain := make([]byte, len(encrypted))
+	digest := salt
+	for i := 0; i < len(encrypted); i += sha1.Size {
+		sum := sha1.Sum(append(append([]byte{}, passwd...), digest...))
+		digest = sum[:]
+		for j := 0; j < sha1.Size && i+j < len(encrypted); j++ {
+			plain[i+j] = encrypted[i+j] ^ digest[j]
+		}
+	}
+
+	sum := sha1.Sum(append(append([]byte{}, passwd...), plain...))
+	if !bytes.Equal(sum[:], check) {
+		t.Fatalf("Private key integrity check failed")
+	}
+	return plain
+}
+
+func readJKSCertificate(t *testing.T, r io.Reader) *x509.Certificate {
+	if certType := readJavaUTF(t, r); certType != jksCertType {
+		t.Fatalf("Unexpected certificate type %q", certType)
+	}
+	cert, err := x509.ParseCertificate(readBlock(t, r))
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+	return cert
+}
+
+func readBlock(t *testing.T, r io.Reader) []byte {
+	var length uint32
+	readBinary(t, r, &length)
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatalf("Error reading block: %v", err)
+	}
+	return data
+}
+
+func readJavaUTF(t *testing.T, r io.Reader) string {
+	var length uint16
+	readBinary(t, r, &length)
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatalf("Error reading string: %v", err)
+	}
+	return string(data)
+}
+
+func readBinary(t *testing.T, r io.Reader, v interface{}) {
+	if err := binary.Read(r, binary.BigEndian, v); err != nil {
+		t.Fatalf("Error reading keystore: %v", err)
+	}
+}
@@ -0,0 +1,423 @@
+// Package keystore encodes certificates and private keys into the binary
+// keystore formats expected by Java and Windows services.
+package keystore
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+const (
+	pkcs12Iterations = 2048
+	pkcs12SaltLen    = 8
+
+	pkcs12KeyID  = 1
+	pkcs12IVID   = 2
+	pkcs12MacID  = 3
+	sha1HashSize = 20
+	sha1Block    = 64
+
+	tagBMPString = 30
+)
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidPBEWithSHAAnd3KeyTDES    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                     = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertTypeX509Certificate  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	AlgorithmIdentifier pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+// EncodePKCS12 produces a password protected PKCS#12 archive containing the
+// private key, its certificate and the CA chain. The key and certificate
+// entries are labelled with friendlyName. Keys and certificates are
+// encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC and the archive is
+// authenticated with HMAC-SHA1, which every Java and Windows release can
+// read.
+func EncodePKCS12(privateKey crypto.PrivateKey, certificate *x509.Certificate, caCerts []*x509.Certificate, friendlyName, password string) ([]byte, error) {
+	encodedPassword, err := bmpString(password)
+	if err != nil {
+		return nil, err
+	}
+
+	localKeyID := sha1.Sum(certificate.Raw)
+	attributes, err := entryAttributes(friendlyName, localKeyID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	bag, err := makeCertBag(certificate.Raw, attributes)
+	if err != nil {
+		return nil, err
+	}
+	certBags = append(certBags, bag)
+	for _, cert := range caCerts {
+		bag, err := makeCertBag(cert.Raw, nil)
+		if err != nil {
+			return nil, err
+		}
+		certBags = append(certBags, bag)
+	}
+
+	keyBag, err := makeShroudedKeyBag(privateKey, encodedPassword, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	certsContent, err := makeEncryptedContentInfo(certBags, encodedPassword)
+	if err != nil {
+		return nil, err
+	}
+	keyContent, err := makeDataContentInfo([]safeBag{keyBag})
+	if err != nil {
+		return nil, err
+	}
+
+	authenticatedSafe, err := asn1.Marshal([]contentInfo{certsContent, keyContent})
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := makeMacData(authenticatedSafe, encodedPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	authSafe, err := makeDataContent(authenticatedSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidDataContentType, Content: authSafe},
+		MacData:  mac,
+	})
+}
+
+func entryAttributes(friendlyName string, localKeyID []byte) ([]pkcs12Attribute, error) {
+	keyID, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []pkcs12Attribute{{
+		Id:    oidLocalKeyID,
+		Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: keyID},
+	}}
+
+	if friendlyName == "" {
+		return attributes, nil
+	}
+
+	name, err := bmpString(friendlyName)
+	if err != nil {
+		return nil, err
+	}
+	// bmpString appends the NUL terminator required for passwords; it is
+	// not part of a BMPString attribute value.
+	name = name[:len(name)-2]
+	encodedName, err := asn1.Marshal(asn1.RawValue{Tag: tagBMPString, Bytes: name})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(attributes, pkcs12Attribute{
+		Id:    oidFriendlyName,
+		Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: encodedName},
+	}), nil
+}
+
+func makeCertBag(der []byte, attributes []pkcs12Attribute) (safeBag, error) {
+	value, err := asn1.Marshal(certBag{Id: oidCertTypeX509Certificate, Data: der})
+	if err != nil {
+		return safeBag{}, err
+	}
+
+	return safeBag{
+		Id:         oidCertBag,
+		Value:      asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+		Attributes: attributes,
+	}, nil
+}
+
+func makeShroudedKeyBag(privateKey crypto.PrivateKey, password []byte, attributes []pkcs12Attribute) (safeBag, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return safeBag{}, fmt.Errorf("unable to encode private key: %v", err)
+	}
+
+	algorithm, encrypted, err := pbeEncrypt(pkcs8, password)
+	if err != nil {
+		return safeBag{}, err
+	}
+
+	value, err := asn1.Marshal(encryptedPrivateKeyInfo{AlgorithmIdentifier: algorithm, EncryptedData: encrypted})
+	if err != nil {
+		return safeBag{}, err
+	}
+
+	return safeBag{
+		Id:         oidPKCS8ShroudedKeyBag,
+		Value:      asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+		Attributes: attributes,
+	}, nil
+}
+
+func makeDataContent(der []byte) (asn1.RawValue, error) {
+	octets, err := asn1.Marshal(der)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octets}, nil
+}
+
+func makeDataContentInfo(bags []safeBag) (contentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	content, err := makeDataContent(safeContents)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	return contentInfo{ContentType: oidDataContentType, Content: content}, nil
+}
+
+func makeEncryptedContentInfo(bags []safeBag, password []byte) (contentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	algorithm, encrypted, err := pbeEncrypt(safeContents, password)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	value, err := asn1.Marshal(encryptedData{
+		Version: 0,
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidDataContentType,
+			ContentEncryptionAlgorithm: algorithm,
+			EncryptedContent:           encrypted,
+		},
+	})
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	return contentInfo{
+		ContentType: oidEncryptedDataContentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value},
+	}, nil
+}
+
+func makeMacData(content, password []byte) (macData, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return macData{}, err
+	}
+
+	key := pbkdf(password, salt, pkcs12MacID, pkcs12Iterations, sha1HashSize)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(content)
+
+	return macData{
+		Mac: digestInfo{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+			Digest:    mac.Sum(nil),
+		},
+		MacSalt:    salt,
+		Iterations: pkcs12Iterations,
+	}, nil
+}
+
+func pbeEncrypt(plaintext, password []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	params, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	key := pbkdf(password, salt, pkcs12KeyID, pkcs12Iterations, 24)
+	iv := pbkdf(password, salt, pkcs12IVID, pkcs12Iterations, des.BlockSize)
+
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, nil, err
+	}
+
+	padding := des.BlockSize - len(plaintext)%des.BlockSize
+	encrypted := make([]byte, len(plaintext)+padding)
+	copy(encrypted, plaintext)
+	for i := len(plaintext); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	algorithm := pkix.AlgorithmIdentifier{
+		Algorithm:  oidPBEWithSHAAnd3KeyTDES,
+		Parameters: asn1.RawValue{FullBytes: params},
+	}
+
+	return algorithm, encrypted, nil
+}
+
+// pbkdf implements the PKCS#12 key derivation function with SHA-1 as
+// described in RFC 7292 appendix B.2.
+func pbkdf(password, salt []byte, id byte, iterations, size int) []byte {
+	d := make([]byte, sha1Block)
+	for i := range d {
+		d[i] = id
+	}
+
+	i := append(fillBlocks(salt), fillBlocks(password)...)
+
+	var out []byte
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+
+		if len(out) < size {
+			b := make([]byte, sha1Block)
+			for k := range b {
+				b[k] = a[k%len(a)]
+			}
+			for j := 0; j < len(i); j += sha1Block {
+				addBlock(i[j:j+sha1Block], b)
+			}
+		}
+	}
+
+	return out[:size]
+}
+
+// fillBlocks repeats b up to the next multiple of the SHA-1 block size.
+func fillBlocks(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+
+	out := make([]byte, sha1Block*((len(b)+sha1Block-1)/sha1Block))
+	for i := range out {
+		out[i] = b[i%len(b)]
+	}
+	return out
+}
+
+// addBlock computes block = (block + b + 1) mod 2^(len(block)*8).
+func addBlock(block, b []byte) {
+	carry := 1
+	for k := len(block) - 1; k >= 0; k-- {
+		sum := int(block[k]) + int(b[k]) + carry
+		block[k] = byte(sum)
+		carry = sum >> 8
+	}
+}
+
+// bmpString encodes s as big-endian UTF-16 with a trailing NUL, as PKCS#12
+// requires for passwords.
+func bmpString(s string) ([]byte, error) {
+	out := make([]byte, 0, 2*len(s)+2)
+	for _, r := range s {
+		if r > 0xffff {
+			return nil, fmt.Errorf("pkcs12: character %q cannot be encoded in a BMPString", r)
+		}
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0), nil
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, pkcs12SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %v", err)
+	}
+	return salt, nil
+}
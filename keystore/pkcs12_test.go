@@ -0,0 +1,255 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+func TestPBKDF(t *testing.T) {
+	// known answer from the PKCS#12 test vectors of golang.org/x/crypto
+	salt := []byte("\xff\xff\xff\xff\xff\xff\xff\xff")
+	password, _ := bmpString("sesame")
+	expected := []byte("\x7c\xd9\xfd\x3e\x2b\x3b\xe7\x69\x1a\x44\xe3\xbe\xf0\xf9\xea\x0f\xb9\xb8\x97\xd4\xe3\x25\xd9\xd1")
+
+	if key := pbkdf(password, salt, pkcs12KeyID, 2048, 24); !bytes.Equal(key, expected) {
+		t.Errorf("Expected key %x, got %x", expected, key)
+	}
+
+	salt = []byte("\xf3\x7e\x05\xb5\x18\x32\x4b\x4b")
+	expected = []byte("\x00\xf7\x59\xff\x47\xd1\x4d\xd0\x36\x65\xd5\x94\x3c\xb3\xc4\xa3\x9a\x25\x55\xc0\x2a\xed\x66\xe1")
+
+	if key := pbkdf([]byte("\x00\x00"), salt, pkcs12KeyID, 2048, 24); !bytes.Equal(key, expected) {
+		t.Errorf("Expected key %x, got %x", expected, key)
+	}
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	key, cert, ca := testCertificates(t)
+
+	pfxData, err := EncodePKCS12(key, cert, []*x509.Certificate{ca}, "my-alias", "changeit")
+	if err != nil {
+		t.Fatalf("Error encoding PKCS#12: %v", err)
+	}
+
+	bags := decodePKCS12(t, pfxData, "changeit")
+
+	var certs []*x509.Certificate
+	var decodedKey interface{}
+	for _, bag := range bags {
+		switch {
+		case bag.Id.Equal(oidCertBag):
+			var cb certBag
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+				t.Fatalf("Error decoding certificate bag: %v", err)
+			}
+			c, err := x509.ParseCertificate(cb.Data)
+			if err != nil {
+				t.Fatalf("Error parsing certificate: %v", err)
+			}
+			certs = append(certs, c)
+		case bag.Id.Equal(oidPKCS8ShroudedKeyBag):
+			var info encryptedPrivateKeyInfo
+			if _, err := asn1.Unmarshal(bag.Value.Bytes, &info); err != nil {
+				t.Fatalf("Error decoding key bag: %v", err)
+			}
+			pkcs8 := pbeDecrypt(t, info.AlgorithmIdentifier, info.EncryptedData, "changeit")
+			decodedKey, err = x509.ParsePKCS8PrivateKey(pkcs8)
+			if err != nil {
+				t.Fatalf("Error parsing private key: %v", err)
+			}
+			if name := friendlyName(t, bag); name != "my-alias" {
+				t.Errorf("Expected friendly name my-alias, got %q", name)
+			}
+		default:
+			t.Errorf("Unexpected bag %v", bag.Id)
+		}
+	}
+
+	if len(certs) != 2 || !certs[0].Equal(cert) || !certs[1].Equal(ca) {
+		t.Errorf("Expected certificate followed by CA in the archive")
+	}
+	ecKey, ok := decodedKey.(*ecdsa.PrivateKey)
+	if !ok || ecKey.D.Cmp(key.D) != 0 {
+		t.Errorf("Decoded private key does not match")
+	}
+}
+
+func TestEncodePKCS12WrongPassword(t *testing.T) {
+	key, cert, _ := testCertificates(t)
+
+	pfxData, err := EncodePKCS12(key, cert, nil, "", "changeit")
+	if err != nil {
+		t.Fatalf("Error encoding PKCS#12: %v", err)
+	}
+
+	var pfx pfxPdu
+	if _, err := asn1.Unmarshal(pfxData, &pfx); err != nil {
+		t.Fatalf("Error decoding PFX: %v", err)
+	}
+	if verifyMac(pfx, "wrong") {
+		t.Errorf("MAC must not verify with the wrong password")
+	}
+}
+
+func testCertificates(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate, *x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test.domain.tld"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return key, cert, ca
+}
+
+func decodePKCS12(t *testing.T, pfxData []byte, password string) []safeBag {
+	var pfx pfxPdu
+	if _, err := asn1.Unmarshal(pfxData, &pfx); err != nil {
+		t.Fatalf("Error decoding PFX: %v", err)
+	}
+	if pfx.Version != 3 {
+		t.Errorf("Expected PFX version 3, got %d", pfx.Version)
+	}
+	if !verifyMac(pfx, password) {
+		t.Fatalf("MAC verification failed")
+	}
+
+	var authenticatedSafe []contentInfo
+	if _, err := asn1.Unmarshal(dataContent(t, pfx.AuthSafe), &authenticatedSafe); err != nil {
+		t.Fatalf("Error decoding authenticated safe: %v", err)
+	}
+
+	var bags []safeBag
+	for _, ci := range authenticatedSafe {
+		var safeContents []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			safeContents = dataContent(t, ci)
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				t.Fatalf("Error decoding encrypted data: %v", err)
+			}
+			info := ed.EncryptedContentInfo
+			safeContents = pbeDecrypt(t, info.ContentEncryptionAlgorithm, info.EncryptedContent, password)
+		default:
+			t.Fatalf("Unexpected content type %v", ci.ContentType)
+		}
+
+		var contents []safeBag
+		if _, err := asn1.Unmarshal(safeContents, &contents); err != nil {
+			t.Fatalf("Error decoding safe contents: %v", err)
+		}
+		bags = append(bags, contents...)
+	}
+
+	return bags
+}
+
+func dataContent(t *testing.T, ci contentInfo) []byte {
+	var data []byte
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &data); err != nil {
+		t.Fatalf("Error decoding data content: %v", err)
+	}
+	return data
+}
+
+func verifyMac(pfx pfxPdu, password string) bool {
+	encodedPassword, _ := bmpString(password)
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return false
+	}
+
+	key := pbkdf(encodedPassword, pfx.MacData.MacSalt, pkcs12MacID, pfx.MacData.Iterations, sha1HashSize)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(authSafe)
+
+	return hmac.Equal(mac.Sum(nil), pfx.MacData.Mac.Digest)
+}
+
+func pbeDecrypt(t *testing.T, algorithm pkix.AlgorithmIdentifier, data []byte, password string) []byte {
+	if !algorithm.Algorithm.Equal(oidPBEWithSHAAnd3KeyTDES) {
+		t.Fatalf("Unexpected encryption algorithm %v", algorithm.Algorithm)
+	}
+	var params pbeParams
+	if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatalf("Error decoding PBE parameters: %v", err)
+	}
+
+	encodedPassword, _ := bmpString(password)
+	key := pbkdf(encodedPassword, params.Salt, pkcs12KeyID, params.Iterations, 24)
+	iv := pbkdf(encodedPassword, params.Salt, pkcs12IVID, params.Iterations, des.BlockSize)
+
+	block, err := des.NewTripleDESCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding < 1 || padding > des.BlockSize {
+		t.Fatalf("Invalid padding, wrong password?")
+	}
+	return plaintext[:len(plaintext)-padding]
+}
+
+func friendlyName(t *testing.T, bag safeBag) string {
+	for _, attr := range bag.Attributes {
+		if !attr.Id.Equal(oidFriendlyName) {
+			continue
+		}
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(attr.Value.Bytes, &value); err != nil {
+			t.Fatalf("Error decoding friendly name: %v", err)
+		}
+		u := make([]uint16, len(value.Bytes)/2)
+		for i := range u {
+			u[i] = uint16(value.Bytes[2*i])<<8 | uint16(value.Bytes[2*i+1])
+		}
+		return string(utf16.Decode(u))
+	}
+	return ""
+}
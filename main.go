@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/vdesjardins/cert-monitor/controller"
 )
@@ -15,7 +16,12 @@ var (
 	oneTime    = flag.Bool("onetime", false, "refresh certificates without entering the endless loop")
 	noReload   = flag.Bool("noreload", false, "do not reload services associated with each certificate")
 	certConfig = flag.String("certconfig", "", "path to a specific certificate configuration")
+	rollback   = flag.String("rollback", "", "restore the previous version of the certificate configuration at this path")
 	status     = flag.Bool("status", false, "print status of all certificates managed by cert-monitor")
+	format     = flag.String("format", controller.StatusFormatTable, "status output format: table, json or yaml")
+	check      = flag.Bool("check", false, "check certificates and exit with a Nagios plugin status")
+	warning    = flag.Duration("warning", 14*24*time.Hour, "remaining lifetime below which -check reports a warning")
+	critical   = flag.Duration("critical", 7*24*time.Hour, "remaining lifetime below which -check reports a critical status")
 	ver        = flag.Bool("version", false, "print version and exit")
 )
 
@@ -28,7 +34,20 @@ func main() {
 	}
 
 	if *status == true {
-		controller.PrintStatus(*configPath)
+		if err := controller.PrintStatus(*configPath, *format); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *check == true {
+		os.Exit(controller.Check(*configPath, *certConfig, *warning, *critical))
+	}
+
+	if *rollback != "" {
+		if err := controller.Rollback(*configPath, *noReload, *rollback); err != nil {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
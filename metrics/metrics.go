@@ -0,0 +1,166 @@
+// Package metrics is a minimal registry of gauges and counters exposed in
+// the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	samples    map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+// Vec is a gauge or counter family partitioned by label values.
+type Vec struct {
+	registry *Registry
+	family   *family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *Vec {
+	return r.register(name, help, "gauge", labelNames)
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *Vec {
+	return r.register(name, help, "counter", labelNames)
+}
+
+func (r *Registry) register(name, help, kind string, labelNames []string) *Vec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		samples:    map[string]*sample{},
+	}
+	r.families = append(r.families, f)
+
+	return &Vec{registry: r, family: f}
+}
+
+// Set replaces the value of the sample with the given label values.
+func (v *Vec) Set(value float64, labelValues ...string) {
+	v.registry.mu.Lock()
+	defer v.registry.mu.Unlock()
+
+	v.sample(labelValues).value = value
+}
+
+// Add increases the value of the sample with the given label values.
+func (v *Vec) Add(value float64, labelValues ...string) {
+	v.registry.mu.Lock()
+	defer v.registry.mu.Unlock()
+
+	v.sample(labelValues).value += value
+}
+
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Delete removes the sample with the given label values.
+func (v *Vec) Delete(labelValues ...string) {
+	v.registry.mu.Lock()
+	defer v.registry.mu.Unlock()
+
+	delete(v.family.samples, sampleKey(labelValues))
+}
+
+func (v *Vec) sample(labelValues []string) *sample {
+	if len(labelValues) != len(v.family.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.family.name, len(v.family.labelNames), len(labelValues)))
+	}
+
+	key := sampleKey(labelValues)
+	s, ok := v.family.samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		v.family.samples[key] = s
+	}
+	return s
+}
+
+func sampleKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// WriteTo writes every family in the Prometheus text format, samples being
+// sorted by label values.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range r.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.samples))
+		for k := range f.samples {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := f.samples[k]
+			b.WriteString(f.name)
+			if len(f.labelNames) > 0 {
+				var labels []string
+				for i, name := range f.labelNames {
+					labels = append(labels, fmt.Sprintf("%s=\"%s\"", name, escape(s.labelValues[i], true)))
+				}
+				b.WriteString("{" + strings.Join(labels, ",") + "}")
+			}
+			b.WriteString(" " + strconv.FormatFloat(s.value, 'f', -1, 64) + "\n")
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// escape escapes backslashes and new lines, and double quotes in label
+// values.
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	if _, err := r.WriteTo(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
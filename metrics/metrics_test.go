@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	notAfter := r.NewGaugeVec("test_not_after", "Expiration time.", "common_name")
+	requests := r.NewCounterVec("test_requests_total", "Requests\\made.")
+
+	notAfter.Set(1.5e9, "b.domain.tld")
+	notAfter.Set(1600000000, "a.domain.tld")
+	notAfter.Set(1, "quoted \"name\"\n")
+	notAfter.Delete("quoted \"name\"\n")
+	notAfter.Set(2, "c\\\"d\n")
+	requests.Inc()
+	requests.Add(2)
+
+	var b bytes.Buffer
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_not_after Expiration time.
+# TYPE test_not_after gauge
+test_not_after{common_name="a.domain.tld"} 1600000000
+test_not_after{common_name="b.domain.tld"} 1500000000
+test_not_after{common_name="c\\\"d\n"} 2
+# HELP test_requests_total Requests\\made.
+# TYPE test_requests_total counter
+test_requests_total 3
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Wrong label count should panic")
+		}
+	}()
+
+	NewRegistry().NewGaugeVec("test", "Test.", "a", "b").Set(1, "a")
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.", "result").Inc("success")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != contentType {
+		t.Errorf("Unexpected content type %v", ct)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	if !bytes.Contains(body, []byte(`test_total{result="success"} 1`)) {
+		t.Errorf("Sample missing from response: %s", body)
+	}
+}
@@ -33,6 +33,9 @@ sleep 1
 path "/pki/web/servers/1/issue/webservers" {
   capabilities = [ "create", "update" ]
 }
+path "/pki/web/servers/1/sign/webservers" {
+  capabilities = [ "create", "update" ]
+}
 EOT
 
     vault auth-enable approle
@@ -66,14 +69,13 @@ alternateNames: [ n1-test.domaintest.net ]
 ttl: 5m
 renewTtl: 2m
 output:
-  file:
-    type: bundle
+  - type: bundle
     name: ${temp_dir}/certs/test.mydomain.net.pem
     perm: 0600
-  items:
-    - certificate
-    - chain
-    - privateKey
+    items:
+      - certificate
+      - chain
+      - privateKey
 EOT
 
 echo "***************************************"
@@ -0,0 +1,163 @@
+package vault
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultKubernetesLoginPath = "/v1/auth/kubernetes/login"
+	DefaultKubernetesJWTFile   = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	DefaultCertLoginPath       = "/v1/auth/cert/login"
+)
+
+// Token is a Vault token returned by an authentication method.
+type Token struct {
+	ClientToken string
+	Renewable   bool
+	// LeaseDuration is 0 when the token never expires.
+	LeaseDuration time.Duration
+}
+
+// AuthMethod obtains a new Vault token. Login is called when the client has
+// no token yet, when its token expired or when Vault refused it.
+type AuthMethod interface {
+	Login(ctx context.Context, client *Client) (Token, error)
+}
+
+// AppRoleAuth logs in with an AppRole role ID and secret ID.
+type AppRoleAuth struct {
+	Path     url.URL
+	RoleId   string
+	SecretId string
+}
+
+type appRoleLoginRequest struct {
+	RoleId   string `json:"role_id"`
+	SecretId string `json:"secret_id"`
+}
+
+func (a *AppRoleAuth) Login(ctx context.Context, client *Client) (Token, error) {
+	loginInfo := appRoleLoginRequest{a.RoleId, a.SecretId}
+
+	return client.postAuthRequest(ctx, client.httpClient(), "Login", a.Path, loginInfo, "")
+}
+
+// TokenAuth uses an existing token: Token, else the content of File (as
+// written by the Vault Agent token sink), else the VAULT_TOKEN environment
+// variable. The file is read again at each login so a token replaced by the
+// agent is picked up after Vault refused the previous one.
+type TokenAuth struct {
+	Token string
+	File  string
+}
+
+func (a *TokenAuth) Login(ctx context.Context, client *Client) (Token, error) {
+	var token string
+
+	switch {
+	case a.Token != "":
+		token = a.Token
+	case a.File != "":
+		content, err := ioutil.ReadFile(a.File)
+		if err != nil {
+			return Token{}, fmt.Errorf("Login: Error reading token file %v: %v", a.File, err)
+		}
+		token = strings.TrimSpace(string(content))
+	default:
+		token = os.Getenv("VAULT_TOKEN")
+	}
+
+	if token == "" {
+		return Token{}, fmt.Errorf("Login: Error: no Vault token available")
+	}
+
+	// the lifetime of the token is managed outside of cert-monitor
+	return Token{ClientToken: token}, nil
+}
+
+// KubernetesAuth logs in with the JWT of the pod service account.
+type KubernetesAuth struct {
+	Path    url.URL
+	Role    string
+	JWTFile string
+}
+
+type kubernetesLoginRequest struct {
+	Role string `json:"role"`
+	JWT  string `json:"jwt"`
+}
+
+func (a *KubernetesAuth) Login(ctx context.Context, client *Client) (Token, error) {
+	jwtFile := a.JWTFile
+	if jwtFile == "" {
+		jwtFile = DefaultKubernetesJWTFile
+	}
+
+	// the service account token is rotated by the kubelet
+	jwt, err := ioutil.ReadFile(jwtFile)
+	if err != nil {
+		return Token{}, fmt.Errorf("Login: Error reading service account token %v: %v", jwtFile, err)
+	}
+
+	loginInfo := kubernetesLoginRequest{a.Role, strings.TrimSpace(string(jwt))}
+
+	return client.postAuthRequest(ctx, client.httpClient(), "Login", pathOrDefault(a.Path, DefaultKubernetesLoginPath), loginInfo, "")
+}
+
+// CertAuth logs in with a TLS client certificate. The key pair is loaded at
+// each login so the certificate can be one renewed by cert-monitor itself.
+type CertAuth struct {
+	Path     url.URL
+	Name     string
+	CertFile string
+	KeyFile  string
+}
+
+type certLoginRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+func (a *CertAuth) Login(ctx context.Context, client *Client) (Token, error) {
+	certificate, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+	if err != nil {
+		return Token{}, fmt.Errorf("Login: Error loading client certificate %v: %v", a.CertFile, err)
+	}
+
+	base := client.httpClient()
+	transport, ok := base.Transport.(*http.Transport)
+	if base.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return Token{}, fmt.Errorf("Login: Error: cert auth requires an HTTP transport")
+	}
+
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	defer transport.CloseIdleConnections()
+
+	httpClient := *base
+	httpClient.Transport = transport
+
+	return client.postAuthRequest(ctx, &httpClient, "Login", pathOrDefault(a.Path, DefaultCertLoginPath), certLoginRequest{a.Name}, "")
+}
+
+func pathOrDefault(path url.URL, defaultPath string) url.URL {
+	if path != (url.URL{}) {
+		return path
+	}
+
+	p, _ := url.Parse(defaultPath)
+	return *p
+}
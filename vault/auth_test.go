@@ -0,0 +1,184 @@
+package vault
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-monitor-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600)
+
+	savedToken, hadToken := os.LookupEnv("VAULT_TOKEN")
+	defer func() {
+		if hadToken {
+			os.Setenv("VAULT_TOKEN", savedToken)
+		} else {
+			os.Unsetenv("VAULT_TOKEN")
+		}
+	}()
+	os.Setenv("VAULT_TOKEN", "env-token")
+
+	tests := []struct {
+		auth     TokenAuth
+		expected string
+	}{
+		{TokenAuth{Token: "static-token", File: tokenFile}, "static-token"},
+		{TokenAuth{File: tokenFile}, "file-token"},
+		{TokenAuth{}, "env-token"},
+	}
+	for _, test := range tests {
+		token, err := test.auth.Login(context.Background(), &Client{})
+		if err != nil {
+			t.Errorf("Error %v", err)
+		}
+		if token.ClientToken != test.expected || token.LeaseDuration != 0 {
+			t.Errorf("Expected non expiring token %v, got %+v", test.expected, token)
+		}
+	}
+
+	os.Unsetenv("VAULT_TOKEN")
+	if _, err := (&TokenAuth{}).Login(context.Background(), &Client{}); err == nil {
+		t.Errorf("Login without any token is supposed to be an error")
+	}
+	if _, err := (&TokenAuth{File: filepath.Join(dir, "missing")}).Login(context.Background(), &Client{}); err == nil {
+		t.Errorf("Login with a missing token file is supposed to be an error")
+	}
+}
+
+func TestKubernetesAuth(t *testing.T) {
+	savedDefaultClient := http.DefaultClient
+	http.DefaultClient = &http.Client{Transport: &mockTransport{}}
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	dir, err := ioutil.TempDir("", "cert-monitor-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	jwtFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(jwtFile, []byte("service-account-jwt"), 0600)
+
+	baseUrl, _ := url.Parse("http://127.0.0.1/")
+	client := &Client{
+		BaseUrl: *baseUrl,
+		Auth:    &KubernetesAuth{Role: "cert-monitor", JWTFile: jwtFile},
+	}
+
+	token, err := client.refreshToken(context.Background())
+	if err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if token != "98a4c7ab-b1fe-361b-ba0b-e307aacfd587" {
+		t.Errorf("Unexpected token %v", token)
+	}
+
+	client = &Client{
+		BaseUrl: *baseUrl,
+		Auth:    &KubernetesAuth{Role: "other", JWTFile: jwtFile},
+	}
+	if _, err := client.refreshToken(context.Background()); err == nil {
+		t.Errorf("Login refused by Vault is supposed to be an error")
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-monitor-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeClientCertificate(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != DefaultCertLoginPath || len(r.TLS.PeerCertificates) == 0 ||
+			r.TLS.PeerCertificates[0].Subject.CommonName != "cert-monitor" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		content, _ := ioutil.ReadFile(filepath.Join("testdata", "login.json"))
+		w.Write(content)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	savedDefaultClient := http.DefaultClient
+	http.DefaultClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	baseUrl, _ := url.Parse(server.URL)
+	client := &Client{
+		BaseUrl: *baseUrl,
+		Auth:    &CertAuth{CertFile: certFile, KeyFile: keyFile},
+	}
+
+	token, err := client.refreshToken(context.Background())
+	if err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if token != "98a4c7ab-b1fe-361b-ba0b-e307aacfd587" {
+		t.Errorf("Unexpected token %v", token)
+	}
+
+	client = &Client{
+		BaseUrl: *baseUrl,
+		Auth:    &CertAuth{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile},
+	}
+	if _, err := client.refreshToken(context.Background()); err == nil {
+		t.Errorf("Login without client certificate is supposed to be an error")
+	}
+}
+
+func writeClientCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cert-monitor"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certFile, keyFile
+}
@@ -0,0 +1,104 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
+)
+
+// maxRedirects limits the standby redirects followed by a request.
+const maxRedirects = 10
+
+// baseUrls returns the addresses of the Vault nodes.
+func (client *Client) baseUrls() []url.URL {
+	if len(client.BaseUrls) > 0 {
+		return client.BaseUrls
+	}
+	return []url.URL{client.BaseUrl}
+}
+
+// sendToNodes posts payload to path on the Vault nodes, starting with the
+// last healthy one. The next node is tried when a node is unreachable or
+// answers with a retryable status, the response of the last node tried
+// being returned when none succeeded.
+func (client *Client) sendToNodes(ctx context.Context, httpClient *http.Client, policy RetryPolicy, path url.URL, payload []byte, header http.Header) (*http.Response, error) {
+	nodes := client.baseUrls()
+	start := int(atomic.LoadInt32(&client.healthyNode)) % len(nodes)
+
+	for i := 0; ; i++ {
+		node := (start + i) % len(nodes)
+		resp, err := postFollowingRedirects(ctx, httpClient, nodes[node].ResolveReference(&path), payload, header)
+		if err == nil && !policy.retryable(resp.StatusCode) {
+			atomic.StoreInt32(&client.healthyNode, int32(node))
+			return resp, nil
+		}
+		if err != nil && (!retryableError(err) || ctx.Err() != nil) {
+			return nil, err
+		}
+		if i == len(nodes)-1 {
+			return resp, err
+		}
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+}
+
+// postFollowingRedirects posts payload to target and follows the 307 and
+// 308 redirects of the Vault standby nodes, sending the payload and the
+// headers again to the active node. Errors raised once the request was
+// written are returned as *sentRequestError.
+func postFollowingRedirects(ctx context.Context, httpClient *http.Client, target *url.URL, payload []byte, header http.Header) (*http.Response, error) {
+	noRedirect := *httpClient
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	for redirects := 0; ; redirects++ {
+		var written int32
+		trace := &httptrace.ClientTrace{
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				if info.Err == nil {
+					atomic.StoreInt32(&written, 1)
+				}
+			},
+		}
+
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodPost, target.String(), bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			if atomic.LoadInt32(&written) == 1 {
+				return nil, &sentRequestError{err}
+			}
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusTemporaryRedirect && resp.StatusCode != http.StatusPermanentRedirect {
+			return resp, nil
+		}
+
+		location, err := resp.Location()
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error following Vault redirect: %v", err)
+		}
+		if redirects == maxRedirects {
+			return nil, fmt.Errorf("Error: stopped after %d Vault redirects", maxRedirects)
+		}
+		target = location
+	}
+}
@@ -0,0 +1,136 @@
+package vault
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newNode returns a Vault node answering with status, or with a token when
+// status is 200, and counting its requests.
+func newNode(t *testing.T, status int) (*httptest.Server, *int32) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "login.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write(content)
+	}))
+
+	return server, &requests
+}
+
+func newHAClient(servers ...*httptest.Server) *Client {
+	var baseUrls []url.URL
+	for _, server := range servers {
+		baseUrl, _ := url.Parse(server.URL)
+		baseUrls = append(baseUrls, *baseUrl)
+	}
+	loginPath, _ := url.Parse("/v1/auth/approle/login")
+
+	return &Client{
+		BaseUrls:  baseUrls,
+		LoginPath: *loginPath,
+		Retry:     &RetryPolicy{MaxAttempts: 1, RetryableStatusCodes: []int{http.StatusServiceUnavailable}},
+	}
+}
+
+func TestFailover(t *testing.T) {
+	down, _ := newNode(t, http.StatusOK)
+	down.Close()
+	standby, standbyRequests := newNode(t, http.StatusServiceUnavailable)
+	defer standby.Close()
+	active, activeRequests := newNode(t, http.StatusOK)
+	defer active.Close()
+
+	client := newHAClient(down, standby, active)
+
+	if _, err := client.login(context.Background()); err != nil {
+		t.Fatalf("Login should fail over to the active node: %v", err)
+	}
+	if atomic.LoadInt32(standbyRequests) != 1 || atomic.LoadInt32(activeRequests) != 1 {
+		t.Errorf("Expected a request to the standby and the active nodes, got %d and %d",
+			atomic.LoadInt32(standbyRequests), atomic.LoadInt32(activeRequests))
+	}
+
+	if _, err := client.login(context.Background()); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if atomic.LoadInt32(standbyRequests) != 1 || atomic.LoadInt32(activeRequests) != 2 {
+		t.Errorf("The last healthy node should be tried first, got %d and %d requests",
+			atomic.LoadInt32(standbyRequests), atomic.LoadInt32(activeRequests))
+	}
+}
+
+func TestFailoverAllNodesDown(t *testing.T) {
+	standby1, _ := newNode(t, http.StatusServiceUnavailable)
+	defer standby1.Close()
+	standby2, _ := newNode(t, http.StatusServiceUnavailable)
+	defer standby2.Close()
+
+	client := newHAClient(standby1, standby2)
+
+	_, err := client.login(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected the status of the last node, got %v", err)
+	}
+}
+
+func TestStandbyRedirect(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "login.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || !strings.Contains(string(body), "role_id") {
+			t.Errorf("Redirected request lost its body: %v %q", r.Method, body)
+		}
+		if r.Header.Get(namespaceHeader) != "team-a" {
+			t.Errorf("Redirected request lost its headers: %v", r.Header)
+		}
+		w.Write(content)
+	}))
+	defer active.Close()
+
+	standby := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, active.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer standby.Close()
+
+	client := newHAClient(standby)
+	client.RoleId = "role"
+	client.AuthNamespace = "team-a"
+
+	if _, err := client.login(context.Background()); err != nil {
+		t.Errorf("Login should follow the standby redirect: %v", err)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	var loop *httptest.Server
+	loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loop.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer loop.Close()
+
+	client := newHAClient(loop)
+
+	if _, err := client.login(context.Background()); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Errorf("Expected a redirect loop error, got %v", err)
+	}
+}
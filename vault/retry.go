@@ -0,0 +1,191 @@
+package vault
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how requests failing with a network error or a
+// retryable status are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of a request, retries
+	// included.
+	MaxAttempts int
+	// BaseBackoff is the wait before the first retry, doubled after each
+	// attempt up to MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Jitter is the fraction, between 0 and 1, of each wait that is
+	// randomized.
+	Jitter               float64
+	RetryableStatusCodes []int
+}
+
+// DefaultRetryPolicy is used by clients without a retry policy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseBackoff: time.Second,
+	MaxBackoff:  30 * time.Second,
+	Jitter:      0.2,
+	RetryableStatusCodes: []int{
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+}
+
+// unprocessedStatusCodes are the statuses Vault answers without processing
+// the request, the only ones certificate requests are retried on.
+var unprocessedStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusServiceUnavailable,
+}
+
+// certificateRequests returns the policy of the issue and sign requests.
+// A 500, 502 or 504 may be raised once Vault issued the certificate, so
+// only the unprocessed statuses are retried.
+func (p RetryPolicy) certificateRequests() RetryPolicy {
+	codes := []int{}
+	for _, c := range unprocessedStatusCodes {
+		if p.retryable(c) {
+			codes = append(codes, c)
+		}
+	}
+	p.RetryableStatusCodes = codes
+	return p
+}
+
+func (p RetryPolicy) retryable(statusCode int) bool {
+	for _, c := range p.RetryableStatusCodes {
+		if c == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// sentRequestError is a network error raised after the request was fully
+// written. Vault may have processed the request, so sending it again could
+// issue a second certificate.
+type sentRequestError struct {
+	err error
+}
+
+func (e *sentRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sentRequestError) Unwrap() error {
+	return e.err
+}
+
+// retryableError reports whether a request failing with err can succeed
+// when sent again. Certificate verification failures are not transient and
+// requests that reached Vault are never sent twice.
+func retryableError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var sent *sentRequestError
+
+	return !errors.As(err, &unknownAuthority) && !errors.As(err, &hostname) && !errors.As(err, &invalid) &&
+		!errors.As(err, &sent)
+}
+
+// backoff returns the wait before the retry following attempt (starting at
+// 1).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := float64(p.BaseBackoff) * math.Pow(2, float64(attempt-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	wait -= wait * p.Jitter * rand.Float64()
+
+	return time.Duration(wait)
+}
+
+// retryAfter parses the Retry-After header, in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func (client *Client) retryPolicy() RetryPolicy {
+	if client.Retry != nil {
+		return *client.Retry
+	}
+	return DefaultRetryPolicy
+}
+
+// send posts payload to path on the Vault nodes, retrying according to
+// policy. The response of the last attempt is returned.
+func (client *Client) send(ctx context.Context, httpClient *http.Client, policy RetryPolicy, path url.URL, payload []byte, header http.Header) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := client.sendToNodes(ctx, httpClient, policy, path, payload, header)
+		if attempt >= policy.MaxAttempts {
+			return resp, err
+		}
+		if err != nil && (!retryableError(err) || ctx.Err() != nil) {
+			return nil, err
+		}
+		if err == nil && !policy.retryable(resp.StatusCode) {
+			return resp, nil
+		}
+
+		wait := policy.backoff(attempt)
+		if err == nil {
+			if after, ok := retryAfter(resp, time.Now()); ok {
+				wait = after
+				if policy.MaxBackoff > 0 && wait > policy.MaxBackoff {
+					wait = policy.MaxBackoff
+				}
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := client.wait(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps for d, returning early with an error when ctx is done.
+func (client *Client) wait(ctx context.Context, d time.Duration) error {
+	if client.sleep != nil {
+		client.sleep(d)
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
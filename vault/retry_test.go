@@ -0,0 +1,252 @@
+package vault
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRetryServer answers the logins with the given status codes in turn,
+// then with a token.
+func newRetryServer(t *testing.T, statusCodes []int, header http.Header) (*httptest.Server, *int) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "login.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if body, _ := ioutil.ReadAll(r.Body); len(body) == 0 {
+			t.Errorf("Request %d sent without payload", requests)
+		}
+		if requests <= len(statusCodes) {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(statusCodes[requests-1])
+			return
+		}
+		w.Write(content)
+	}))
+
+	return server, &requests
+}
+
+func newRetryClient(server *httptest.Server, policy *RetryPolicy, waits *[]time.Duration) *Client {
+	baseUrl, _ := url.Parse(server.URL)
+	loginPath, _ := url.Parse("/login")
+
+	return &Client{
+		BaseUrl:    *baseUrl,
+		LoginPath:  *loginPath,
+		HTTPClient: server.Client(),
+		Retry:      policy,
+		sleep:      func(d time.Duration) { *waits = append(*waits, d) },
+	}
+}
+
+func TestRetry(t *testing.T) {
+	server, requests := newRetryServer(t, []int{503, 502}, nil)
+	defer server.Close()
+
+	var waits []time.Duration
+	client := newRetryClient(server, &RetryPolicy{
+		MaxAttempts:          3,
+		BaseBackoff:          time.Second,
+		MaxBackoff:           time.Minute,
+		RetryableStatusCodes: []int{502, 503},
+	}, &waits)
+
+	if _, err := client.refreshToken(context.Background()); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", *requests)
+	}
+	if len(waits) != 2 || waits[0] != time.Second || waits[1] != 2*time.Second {
+		t.Errorf("Unexpected backoff %v", waits)
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	server, requests := newRetryServer(t, []int{503, 503, 503}, nil)
+	defer server.Close()
+
+	var waits []time.Duration
+	client := newRetryClient(server, &RetryPolicy{
+		MaxAttempts:          2,
+		BaseBackoff:          time.Second,
+		RetryableStatusCodes: []int{503},
+	}, &waits)
+
+	if _, err := client.refreshToken(context.Background()); err == nil {
+		t.Errorf("Login is supposed to fail after 2 attempts")
+	}
+	if *requests != 2 {
+		t.Errorf("Expected 2 requests, got %d", *requests)
+	}
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	server, requests := newRetryServer(t, []int{400}, nil)
+	defer server.Close()
+
+	var waits []time.Duration
+	client := newRetryClient(server, nil, &waits)
+
+	if _, err := client.refreshToken(context.Background()); err == nil {
+		t.Errorf("Status code 400 is supposed to be an error")
+	}
+	if *requests != 1 || len(waits) != 0 {
+		t.Errorf("Status code 400 should not be retried: %d requests", *requests)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, _ := newRetryServer(t, []int{429}, http.Header{"Retry-After": []string{"7"}})
+	defer server.Close()
+
+	var waits []time.Duration
+	client := newRetryClient(server, nil, &waits)
+
+	if _, err := client.refreshToken(context.Background()); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if len(waits) != 1 || waits[0] != 7*time.Second {
+		t.Errorf("Retry-After not honored: %v", waits)
+	}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	resp := &http.Response{Header: http.Header{"Retry-After": []string{now.Add(time.Minute).Format(http.TimeFormat)}}}
+	if wait, ok := retryAfter(resp, now); !ok || wait != time.Minute {
+		t.Errorf("Expected a Retry-After date of 1m, got %v", wait)
+	}
+}
+
+func TestRetryAfterCapped(t *testing.T) {
+	server, _ := newRetryServer(t, []int{429}, http.Header{"Retry-After": []string{"86400"}})
+	defer server.Close()
+
+	var waits []time.Duration
+	client := newRetryClient(server, &RetryPolicy{
+		MaxAttempts:          2,
+		BaseBackoff:          time.Second,
+		MaxBackoff:           30 * time.Second,
+		RetryableStatusCodes: []int{429},
+	}, &waits)
+
+	if _, err := client.refreshToken(context.Background()); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if len(waits) != 1 || waits[0] != 30*time.Second {
+		t.Errorf("Retry-After should be capped by MaxBackoff: %v", waits)
+	}
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		ioutil.ReadAll(r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	var waits []time.Duration
+	client := newRetryClient(server, &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Second}, &waits)
+
+	if _, err := client.refreshToken(context.Background()); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if atomic.LoadInt32(&requests) != 1 || len(waits) != 0 {
+		t.Errorf("A request that reached Vault must not be sent again, got %d requests", requests)
+	}
+
+	// nothing was sent when the connection is refused
+	server.Close()
+	if _, err := client.refreshToken(context.Background()); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if len(waits) != 2 {
+		t.Errorf("Refused connections should be retried, got %v", waits)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	policy := RetryPolicy{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second, Jitter: 0.5}
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if wait := policy.backoff(attempt + 1); wait > max || wait < max/2 {
+				t.Fatalf("Backoff of attempt %d out of [%v, %v]: %v", attempt+1, max/2, max, wait)
+			}
+		}
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	server, requests := newRetryServer(t, []int{503, 503, 503}, nil)
+	defer server.Close()
+
+	baseUrl, _ := url.Parse(server.URL)
+	loginPath, _ := url.Parse("/login")
+	client := &Client{
+		BaseUrl:    *baseUrl,
+		LoginPath:  *loginPath,
+		HTTPClient: server.Client(),
+		Retry:      &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Hour, RetryableStatusCodes: []int{503}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := client.refreshToken(ctx); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("Expected the login to be cancelled, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second || *requests != 1 {
+		t.Errorf("The backoff should be interrupted by the cancellation: %v, %d requests", time.Since(start), *requests)
+	}
+}
+
+func TestRetryCertificateRequest(t *testing.T) {
+	server, requests := newRetryServer(t, []int{500}, nil)
+	defer server.Close()
+
+	var waits []time.Duration
+	client := newRetryClient(server, nil, &waits)
+	certPath, _ := url.Parse("/issue")
+	client.CertPath = *certPath
+
+	// Vault may have issued the certificate before failing
+	if _, err := client.fetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}, "dummy token"); err == nil {
+		t.Errorf("Status code 500 is supposed to be an error")
+	}
+	if *requests != 1 || len(waits) != 0 {
+		t.Errorf("Certificate requests should not be retried on a 500, got %d requests", *requests)
+	}
+
+	server, requests = newRetryServer(t, []int{503, 429}, nil)
+	defer server.Close()
+	client = newRetryClient(server, nil, &waits)
+	client.CertPath = *certPath
+
+	if _, err := client.fetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}, "dummy token"); err != nil {
+		t.Errorf("Error %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("Certificate requests should be retried on 503 and 429, got %d requests", *requests)
+	}
+}
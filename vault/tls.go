@@ -0,0 +1,81 @@
+package vault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const DefaultTimeout = 60 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig describes how the connection to Vault is secured.
+type TLSConfig struct {
+	// CACert is a PEM bundle of the CAs trusted instead of the system
+	// ones.
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	ServerName string
+	// MinVersion is the minimum TLS version: 1.0, 1.1, 1.2 or 1.3.
+	MinVersion         string
+	InsecureSkipVerify bool
+}
+
+// NewHTTPClient returns an HTTP client for Vault using the TLS
+// configuration. Requests time out after timeout, DefaultTimeout when 0.
+func NewHTTPClient(tlsConfig TLSConfig, timeout time.Duration) (*http.Client, error) {
+	config := &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+
+	if tlsConfig.MinVersion != "" {
+		version, ok := tlsVersions[tlsConfig.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Error: TLS version %v is invalid. Valid values are: 1.0, 1.1, 1.2, 1.3", tlsConfig.MinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if tlsConfig.CACert != "" {
+		content, err := ioutil.ReadFile(tlsConfig.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA certificate %v: %v", tlsConfig.CACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("Error: no certificate found in %v", tlsConfig.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if tlsConfig.ClientCert != "" || tlsConfig.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(tlsConfig.ClientCert, tlsConfig.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate %v: %v", tlsConfig.ClientCert, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
@@ -0,0 +1,133 @@
+package vault
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newLoginServer(delay time.Duration) *httptest.Server {
+	return httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		content, _ := ioutil.ReadFile(filepath.Join("testdata", "login.json"))
+		w.Write(content)
+	}))
+}
+
+func loginWith(server *httptest.Server, tlsConfig TLSConfig, timeout time.Duration) error {
+	httpClient, err := NewHTTPClient(tlsConfig, timeout)
+	if err != nil {
+		return err
+	}
+
+	baseUrl, _ := url.Parse(server.URL)
+	loginPath, _ := url.Parse("/login")
+	client := &Client{BaseUrl: *baseUrl, LoginPath: *loginPath, HTTPClient: httpClient, Retry: &RetryPolicy{MaxAttempts: 1}}
+
+	_, err = client.refreshToken(context.Background())
+	return err
+}
+
+func writeServerCA(t *testing.T, dir string, server *httptest.Server) string {
+	caFile := filepath.Join(dir, "ca.pem")
+	content := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return caFile
+}
+
+func TestNewHTTPClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-monitor-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newLoginServer(0)
+	server.StartTLS()
+	defer server.Close()
+	caFile := writeServerCA(t, dir, server)
+
+	if err := loginWith(server, TLSConfig{}, 0); err == nil {
+		t.Errorf("Server signed by an unknown CA is supposed to be an error")
+	}
+	if err := loginWith(server, TLSConfig{CACert: caFile}, 0); err != nil {
+		t.Errorf("Server signed by the configured CA should be trusted: %v", err)
+	}
+	if err := loginWith(server, TLSConfig{CACert: caFile, ServerName: "vault.domain.tld"}, 0); err == nil {
+		t.Errorf("Server name mismatch is supposed to be an error")
+	}
+	if err := loginWith(server, TLSConfig{InsecureSkipVerify: true}, 0); err != nil {
+		t.Errorf("Verification should be skipped: %v", err)
+	}
+	if _, err := NewHTTPClient(TLSConfig{CACert: filepath.Join(dir, "missing.pem")}, 0); err == nil {
+		t.Errorf("Missing CA file is supposed to be an error")
+	}
+}
+
+func TestNewHTTPClientMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-monitor-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeClientCertificate(t, dir)
+	clientPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, _ := x509.ParseCertificate(clientPair.Certificate[0])
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := newLoginServer(0)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := writeServerCA(t, dir, server)
+
+	if err := loginWith(server, TLSConfig{CACert: caFile}, 0); err == nil {
+		t.Errorf("Missing client certificate is supposed to be an error")
+	}
+	if err := loginWith(server, TLSConfig{CACert: caFile, ClientCert: certFile, ClientKey: keyFile}, 0); err != nil {
+		t.Errorf("Client certificate should be accepted: %v", err)
+	}
+}
+
+func TestNewHTTPClientMinVersion(t *testing.T) {
+	server := newLoginServer(0)
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	if err := loginWith(server, TLSConfig{InsecureSkipVerify: true, MinVersion: "1.2"}, 0); err != nil {
+		t.Errorf("TLS 1.2 should be accepted: %v", err)
+	}
+	if err := loginWith(server, TLSConfig{InsecureSkipVerify: true, MinVersion: "1.3"}, 0); err == nil {
+		t.Errorf("Server without TLS 1.3 is supposed to be an error")
+	}
+	if _, err := NewHTTPClient(TLSConfig{MinVersion: "1.4"}, 0); err == nil {
+		t.Errorf("Unknown TLS version is supposed to be an error")
+	}
+}
+
+func TestNewHTTPClientTimeout(t *testing.T) {
+	server := newLoginServer(500 * time.Millisecond)
+	server.StartTLS()
+	defer server.Close()
+
+	if err := loginWith(server, TLSConfig{InsecureSkipVerify: true}, 50*time.Millisecond); err == nil {
+		t.Errorf("Slow Vault response is supposed to time out")
+	}
+}
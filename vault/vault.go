@@ -1,11 +1,19 @@
 package vault
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRenewPath = "/v1/auth/token/renew-self"
+
+	namespaceHeader = "X-Vault-Namespace"
 )
 
 type CertResponse struct {
@@ -19,60 +27,280 @@ type CertResponse struct {
 }
 
 type CertRequest struct {
-	CommonName     string `json:"common_name"`
-	AlternateNames string `json:"alt_names"`
-	TTL            string `json:"ttl,omitempty"`
+	CommonName        string `json:"common_name"`
+	AlternateNames    string `json:"alt_names"`
+	IPSans            string `json:"ip_sans,omitempty"`
+	URISans           string `json:"uri_sans,omitempty"`
+	OtherSans         string `json:"other_sans,omitempty"`
+	ExcludeCNFromSans bool   `json:"exclude_cn_from_sans,omitempty"`
+	TTL               string `json:"ttl,omitempty"`
+	KeyType           string `json:"key_type,omitempty"`
+	KeyBits           int    `json:"key_bits,omitempty"`
+	PrivateKeyFormat  string `json:"private_key_format,omitempty"`
+	Format            string `json:"format,omitempty"`
 }
 
+type SignRequest struct {
+	CertRequest
+	CSR string `json:"csr"`
+}
+
+// Client issues certificates from Vault. The token obtained at login is
+// reused by every request, renewed once two thirds of its lease have
+// elapsed and replaced by a new login when it expires or is refused.
 type Client struct {
-	BaseUrl   url.URL
+	BaseUrl url.URL
+	// BaseUrls are the addresses of the nodes of a Vault cluster, used
+	// instead of BaseUrl when set. The next node is tried when one is
+	// unavailable and the last healthy node is tried first.
+	BaseUrls []url.URL
+
 	LoginPath url.URL
 	CertPath  url.URL
+	SignPath  url.URL
+	RenewPath url.URL
 	RoleId    string
 	SecretId  string
+
+	// Namespace is the Vault Enterprise namespace of the requests, sent as
+	// X-Vault-Namespace. The login and token requests use AuthNamespace
+	// instead, the root namespace when it is empty.
+	Namespace     string
+	AuthNamespace string
+
+	// Auth is the authentication method used to log in. AppRole with
+	// LoginPath, RoleId and SecretId is used when it is nil.
+	Auth AuthMethod
+
+	// HTTPClient is used for every request, http.DefaultClient when nil.
+	HTTPClient *http.Client
+
+	// Retry is the retry policy of the requests, DefaultRetryPolicy when
+	// nil.
+	Retry *RetryPolicy
+
+	// Observe, when set, is called after every Vault request with the
+	// operation (login, renew, issue or sign) and its error.
+	Observe func(operation string, err error)
+
+	// Tokens is shared by the clients logging in with the same auth method
+	// and namespace. The client keeps its own token when it is nil.
+	Tokens *TokenCache
+
+	ownTokens TokenCache
+
+	// healthyNode is the index in BaseUrls of the last node that answered.
+	healthyNode int32
+
+	// sleep waits between retries, replaced in tests.
+	sleep func(time.Duration)
+}
+
+// TokenCache holds the Vault token of one or more clients.
+type TokenCache struct {
+	mu    sync.Mutex
+	token vaultToken
+}
+
+type vaultToken struct {
+	value     string
+	renewable bool
+	issued    time.Time
+	// ttl is the lease duration of the token, 0 when it never expires.
+	ttl time.Duration
+}
+
+// expired reports whether the token is expired or about to, keeping a
+// tenth of the lease as a safety margin.
+func (t vaultToken) expired(now time.Time) bool {
+	return t.ttl > 0 && !now.Before(t.issued.Add(t.ttl-t.ttl/10))
+}
+
+func (t vaultToken) renewDue(now time.Time) bool {
+	return t.renewable && t.ttl > 0 && !now.Before(t.issued.Add(t.ttl*2/3))
+}
+
+// responseError is returned when Vault answers with an unexpected status.
+type responseError struct {
+	statusCode int
+	message    string
 }
 
-type loginRequest struct {
-	RoleId   string `json:"role_id"`
-	SecretId string `json:"secret_id"`
+func (e *responseError) Error() string {
+	return e.message
+}
+
+func isForbidden(err error) bool {
+	e, ok := err.(*responseError)
+	return ok && e.statusCode == http.StatusForbidden
 }
 
 type loginResponse struct {
 	Auth struct {
-		ClientToken string `json:"client_token"`
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
 	} `json:"auth"`
 	Errors []string `json:"errors"`
 }
 
-func (client Client) FetchNewCertificate(certReq CertRequest) (CertResponse, error) {
+func (client *Client) FetchNewCertificate(ctx context.Context, certReq CertRequest) (CertResponse, error) {
+	return client.withToken(ctx, "issue", func(vaultToken string) (CertResponse, error) {
+		return client.fetchNewCertificate(ctx, certReq, vaultToken)
+	})
+}
+
+func (client *Client) SignCertificate(ctx context.Context, signReq SignRequest) (CertResponse, error) {
+	return client.withToken(ctx, "sign", func(vaultToken string) (CertResponse, error) {
+		return client.signCertificate(ctx, signReq, vaultToken)
+	})
+}
+
+// withToken runs request with the cached token. A request refused with 403
+// is retried once with a new token.
+func (client *Client) withToken(ctx context.Context, operation string, request func(vaultToken string) (CertResponse, error)) (CertResponse, error) {
 	var message CertResponse
 
-	vaultToken, err := client.refreshToken()
+	vaultToken, err := client.refreshToken(ctx)
+	if err != nil {
+		return message, fmt.Errorf("Error refreshing Vault token: %v", err)
+	}
+
+	message, err = request(vaultToken)
+	client.observe(operation, err)
+	if !isForbidden(err) {
+		return message, err
+	}
+
+	client.invalidateToken(vaultToken)
+	vaultToken, err = client.refreshToken(ctx)
 	if err != nil {
 		return message, fmt.Errorf("Error refreshing Vault token: %v", err)
 	}
 
-	return client.fetchNewCertificate(certReq, vaultToken)
+	message, err = request(vaultToken)
+	client.observe(operation, err)
+
+	return message, err
+}
+
+func (client *Client) observe(operation string, err error) {
+	if client.Observe != nil {
+		client.Observe(operation, err)
+	}
+}
+
+func (client *Client) tokens() *TokenCache {
+	if client.Tokens != nil {
+		return client.Tokens
+	}
+	return &client.ownTokens
 }
 
-func (client Client) refreshToken() (string, error) {
-	loginInfo := loginRequest{client.RoleId, client.SecretId}
+// refreshToken returns the cached token, renewing it or logging in again
+// when needed.
+func (client *Client) refreshToken(ctx context.Context) (string, error) {
+	tokens := client.tokens()
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
 
-	loginPayload := &bytes.Buffer{}
-	err := json.NewEncoder(loginPayload).Encode(loginInfo)
+	now := time.Now()
+	cached := tokens.token
+	if cached.value != "" && !cached.expired(now) {
+		if !cached.renewDue(now) {
+			return cached.value, nil
+		}
+
+		renewed, err := client.renewToken(ctx, cached.value)
+		client.observe("renew", err)
+		if err == nil {
+			tokens.token = renewed
+			return renewed.value, nil
+		}
+	}
+
+	token, err := client.login(ctx)
+	client.observe("login", err)
 	if err != nil {
-		return "", fmt.Errorf("Error marshalling Vault request: %v", err)
+		tokens.token = vaultToken{}
+		return "", err
+	}
+
+	tokens.token = token
+	return token.value, nil
+}
+
+// invalidateToken forgets the cached token unless it was already replaced.
+func (client *Client) invalidateToken(value string) {
+	tokens := client.tokens()
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	if tokens.token.value == value {
+		tokens.token = vaultToken{}
+	}
+}
+
+func (client *Client) login(ctx context.Context) (vaultToken, error) {
+	auth := client.Auth
+	if auth == nil {
+		auth = &AppRoleAuth{Path: client.LoginPath, RoleId: client.RoleId, SecretId: client.SecretId}
 	}
 
-	url := client.BaseUrl.ResolveReference(&client.LoginPath).String()
-	req, err := http.NewRequest(http.MethodPost, url, loginPayload)
+	token, err := auth.Login(ctx, client)
 	if err != nil {
-		return "", fmt.Errorf("Error creating Vault request: %v", err)
+		return vaultToken{}, err
 	}
+	return newVaultToken(token), nil
+}
+
+func (client *Client) renewToken(ctx context.Context, value string) (vaultToken, error) {
+	renewPath := pathOrDefault(client.RenewPath, DefaultRenewPath)
 
-	resp, err := http.DefaultClient.Do(req)
+	token, err := client.postAuthRequest(ctx, client.httpClient(), "Renew token", renewPath, struct{}{}, value)
 	if err != nil {
-		return "", fmt.Errorf("Error calling Vault: %v", err)
+		return vaultToken{}, err
+	}
+	return newVaultToken(token), nil
+}
+
+func newVaultToken(token Token) vaultToken {
+	return vaultToken{
+		value:     token.ClientToken,
+		renewable: token.Renewable,
+		issued:    time.Now(),
+		ttl:       token.LeaseDuration,
+	}
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// postAuthRequest sends a login or token request and returns the token of
+// the response.
+func (client *Client) postAuthRequest(ctx context.Context, httpClient *http.Client, action string, path url.URL, payload interface{}, clientToken string) (Token, error) {
+	var token Token
+
+	authPayload, err := json.Marshal(payload)
+	if err != nil {
+		return token, fmt.Errorf("%s: Error marshalling Vault request: %v", action, err)
+	}
+
+	header := http.Header{}
+	if clientToken != "" {
+		header.Add("X-Vault-Token", clientToken)
+	}
+	if client.AuthNamespace != "" {
+		header.Add(namespaceHeader, client.AuthNamespace)
+	}
+
+	resp, err := client.send(ctx, httpClient, client.retryPolicy(), path, authPayload, header)
+	if err != nil {
+		return token, fmt.Errorf("%s: Error calling Vault: %v", action, err)
 	}
 	defer resp.Body.Close()
 
@@ -84,39 +312,50 @@ func (client Client) refreshToken() (string, error) {
 			errors = fmt.Sprintf("errors: %v", message.Errors)
 		}
 
-		return "", fmt.Errorf("Error: vault auth status: %d %v", resp.StatusCode, errors)
+		return token, &responseError{resp.StatusCode, fmt.Sprintf("%s: Error: vault auth status: %d %v", action, resp.StatusCode, errors)}
 	}
 
 	var message loginResponse
 	err = json.NewDecoder(resp.Body).Decode(&message)
 	if err != nil {
-		return "", err
+		return token, fmt.Errorf("%s: Error reading Vault response: %v", action, err)
+	}
+	if message.Auth.ClientToken == "" {
+		return token, fmt.Errorf("%s: Error: vault response has no client token", action)
 	}
 
-	return message.Auth.ClientToken, nil
+	return Token{
+		ClientToken:   message.Auth.ClientToken,
+		Renewable:     message.Auth.Renewable,
+		LeaseDuration: time.Duration(message.Auth.LeaseDuration) * time.Second,
+	}, nil
 }
 
-func (client Client) fetchNewCertificate(certReq CertRequest, vaultToken string) (CertResponse, error) {
-	var message CertResponse
+func (client *Client) fetchNewCertificate(ctx context.Context, certReq CertRequest, vaultToken string) (CertResponse, error) {
+	return client.postCertificateRequest(ctx, "Fetch certificate", client.CertPath, certReq, vaultToken)
+}
 
-	certPayload := &bytes.Buffer{}
-	err := json.NewEncoder(certPayload).Encode(certReq)
-	if err != nil {
-		return message, fmt.Errorf("Fetch certificate: Error marshalling Vault request: %v", err)
-	}
+func (client *Client) signCertificate(ctx context.Context, signReq SignRequest, vaultToken string) (CertResponse, error) {
+	return client.postCertificateRequest(ctx, "Sign certificate", client.SignPath, signReq, vaultToken)
+}
 
-	url := client.BaseUrl.ResolveReference(&client.CertPath).String()
+func (client *Client) postCertificateRequest(ctx context.Context, action string, path url.URL, payload interface{}, vaultToken string) (CertResponse, error) {
+	var message CertResponse
 
-	req, err := http.NewRequest(http.MethodPost, url, certPayload)
+	certPayload, err := json.Marshal(payload)
 	if err != nil {
-		return message, fmt.Errorf("Fetch certificate: Error creating request: %v", err)
+		return message, fmt.Errorf("%s: Error marshalling Vault request: %v", action, err)
 	}
 
-	req.Header.Add("X-Vault-Token", vaultToken)
+	header := http.Header{}
+	header.Add("X-Vault-Token", vaultToken)
+	if client.Namespace != "" {
+		header.Add(namespaceHeader, client.Namespace)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.send(ctx, client.httpClient(), client.retryPolicy().certificateRequests(), path, certPayload, header)
 	if err != nil {
-		return message, fmt.Errorf("Fetch certificate: Error calling Vault: %v", err)
+		return message, fmt.Errorf("%s: Error calling Vault: %v", action, err)
 	}
 	defer resp.Body.Close()
 
@@ -124,13 +363,13 @@ func (client Client) fetchNewCertificate(certReq CertRequest, vaultToken string)
 
 	if resp.StatusCode != 200 {
 		if err != nil {
-			return message, fmt.Errorf("Fetch certificate: Error: vault status: %d", resp.StatusCode)
+			return message, &responseError{resp.StatusCode, fmt.Sprintf("%s: Error: vault status: %d", action, resp.StatusCode)}
 		}
-		return message, fmt.Errorf("Fetch certificate: Error: vault status: %d errors: %v", resp.StatusCode, message.Errors)
+		return message, &responseError{resp.StatusCode, fmt.Sprintf("%s: Error: vault status: %d errors: %v", action, resp.StatusCode, message.Errors)}
 	}
 
 	if err != nil {
-		return message, fmt.Errorf("Fetch certificate: Error reading Vault response: %v", err)
+		return message, fmt.Errorf("%s: Error reading Vault response: %v", action, err)
 	}
 
 	return message, nil
@@ -2,6 +2,8 @@ package vault
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,20 +11,47 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
-type mockTransport struct{}
+type mockTransport struct {
+	logins   int
+	renewals int
+	// failRenewal refuses token renewals with 403.
+	failRenewal bool
+	// forbidOnce refuses the next certificate request with 403.
+	forbidOnce bool
+	// namespaces records the path and namespace of every request.
+	namespaces []string
+}
 
 func (t *mockTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.namespaces = append(t.namespaces, request.URL.Path+"="+request.Header.Get("X-Vault-Namespace"))
+
 	switch request.URL.Path {
 	case "/certs":
+		if t.forbidOnce {
+			t.forbidOnce = false
+			return t.handleForbidden(request)
+		}
 		return t.handleCertRequest(request)
 	case "/certs/404":
 		return t.handleCertRequest404(request)
 	case "/certs/name-invalid":
 		return t.handleNameInvalid(request)
+	case "/sign":
+		return t.handleSignRequest(request)
 	case "/login":
+		t.logins++
 		return t.handleRefreshToken(request)
+	case DefaultKubernetesLoginPath:
+		return t.handleKubernetesLogin(request)
+	case DefaultRenewPath:
+		t.renewals++
+		if t.failRenewal {
+			return t.handleForbidden(request)
+		}
+		return readTestData("renew_self.json", request)
 	default:
 		return nil, fmt.Errorf("Unknown request %v", request.URL.Path)
 	}
@@ -41,10 +70,41 @@ func (t *mockTransport) handleCertRequest(request *http.Request) (*http.Response
 	return readTestData("new_cert.json", request)
 }
 
+func (t *mockTransport) handleSignRequest(request *http.Request) (*http.Response, error) {
+	var signReq SignRequest
+	if err := json.NewDecoder(request.Body).Decode(&signReq); err != nil {
+		return nil, err
+	}
+	if signReq.CSR == "" {
+		response, err := readTestData("name_invalid.json", request)
+		response.StatusCode = 400
+		return response, err
+	}
+	return readTestData("sign_cert.json", request)
+}
+
 func (t *mockTransport) handleRefreshToken(request *http.Request) (*http.Response, error) {
 	return readTestData("login.json", request)
 }
 
+func (t *mockTransport) handleKubernetesLogin(request *http.Request) (*http.Response, error) {
+	var loginReq kubernetesLoginRequest
+	if err := json.NewDecoder(request.Body).Decode(&loginReq); err != nil {
+		return nil, err
+	}
+	if loginReq.Role != "cert-monitor" || loginReq.JWT != "service-account-jwt" {
+		return t.handleForbidden(request)
+	}
+	return readTestData("login.json", request)
+}
+
+func (t *mockTransport) handleForbidden(request *http.Request) (*http.Response, error) {
+	response := http.Response{}
+	response.Body = ioutil.NopCloser(strings.NewReader(`{"errors":["permission denied"]}`))
+	response.StatusCode = 403
+	return &response, nil
+}
+
 func (t *mockTransport) handleNameInvalid(request *http.Request) (*http.Response, error) {
 	response, err := readTestData("name_invalid.json", request)
 	response.StatusCode = 400
@@ -79,7 +139,7 @@ func TestRefreshToken(t *testing.T) {
 		SecretId:  "secret",
 	}
 
-	authToken, err := client.refreshToken()
+	authToken, err := client.refreshToken(context.Background())
 	if err != nil {
 		t.Errorf("Error %v", err)
 	}
@@ -136,8 +196,215 @@ func requestCertificate(testUrl string, assertion func(err error)) {
 	}
 	vaultToken := "dummy token"
 
-	_, err := config.fetchNewCertificate(certReq, vaultToken)
+	_, err := config.fetchNewCertificate(context.Background(), certReq, vaultToken)
 	assertion(err)
 
 	http.DefaultClient = savedDefaultClient
 }
+
+func TestSignCertificate(t *testing.T) {
+	savedDefaultClient := http.DefaultClient
+	http.DefaultClient = &http.Client{Transport: &mockTransport{}}
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	baseUrl, _ := url.Parse("http://127.0.0.1/")
+	signPath, _ := url.Parse("/sign")
+
+	client := Client{
+		BaseUrl:  *baseUrl,
+		SignPath: *signPath,
+	}
+	signReq := SignRequest{
+		CertRequest: CertRequest{CommonName: "test.domain.com"},
+		CSR:         "-----BEGIN CERTIFICATE REQUEST-----",
+	}
+
+	cert, err := client.signCertificate(context.Background(), signReq, "dummy token")
+	if err != nil {
+		t.Errorf("Error %v", err)
+	}
+	if cert.Data.Certificate == "" {
+		t.Errorf("Expected a signed certificate")
+	}
+	if cert.Data.PrivateKey != "" {
+		t.Errorf("Sign response must not contain a private key")
+	}
+
+	signReq.CSR = ""
+	if _, err := client.signCertificate(context.Background(), signReq, "dummy token"); err == nil {
+		t.Errorf("Sign request without CSR is supposed to be an error")
+	}
+}
+
+func TestObserve(t *testing.T) {
+	savedDefaultClient := http.DefaultClient
+	http.DefaultClient = &http.Client{Transport: &mockTransport{}}
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	baseUrl, _ := url.Parse("http://127.0.0.1/")
+	loginPath, _ := url.Parse("/login")
+	certPath, _ := url.Parse("/certs/404")
+
+	var observed []string
+	client := Client{
+		BaseUrl:   *baseUrl,
+		LoginPath: *loginPath,
+		CertPath:  *certPath,
+		Observe: func(operation string, err error) {
+			observed = append(observed, fmt.Sprintf("%s:%v", operation, err != nil))
+		},
+	}
+
+	if _, err := client.FetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}); err == nil {
+		t.Errorf("Error status code 404 is supposed the be an error")
+	}
+	if strings.Join(observed, " ") != "login:false issue:true" {
+		t.Errorf("Unexpected observed requests %v", observed)
+	}
+}
+
+func newTokenTestClient(transport *mockTransport) *Client {
+	http.DefaultClient = &http.Client{Transport: transport}
+
+	baseUrl, _ := url.Parse("http://127.0.0.1/")
+	loginPath, _ := url.Parse("/login")
+	certPath, _ := url.Parse("/certs")
+
+	return &Client{
+		BaseUrl:   *baseUrl,
+		LoginPath: *loginPath,
+		CertPath:  *certPath,
+		RoleId:    "role",
+		SecretId:  "secret",
+	}
+}
+
+func TestTokenCaching(t *testing.T) {
+	savedDefaultClient := http.DefaultClient
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	transport := &mockTransport{}
+	client := newTokenTestClient(transport)
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.FetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}); err != nil {
+			t.Fatalf("Error %v", err)
+		}
+	}
+	if transport.logins != 1 {
+		t.Errorf("Expected a single login, got %d", transport.logins)
+	}
+	if client.tokens().token.ttl != 2764800*time.Second || !client.tokens().token.renewable {
+		t.Errorf("Token lease not recorded: %+v", client.tokens().token)
+	}
+}
+
+func TestTokenRenewal(t *testing.T) {
+	savedDefaultClient := http.DefaultClient
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	transport := &mockTransport{}
+	client := newTokenTestClient(transport)
+
+	if _, err := client.refreshToken(context.Background()); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+
+	// two thirds of the lease elapsed
+	client.tokens().token.issued = time.Now().Add(-client.tokens().token.ttl * 3 / 4)
+	token, err := client.refreshToken(context.Background())
+	if err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if transport.renewals != 1 || transport.logins != 1 {
+		t.Errorf("Expected 1 renewal and 1 login, got %d and %d", transport.renewals, transport.logins)
+	}
+	if token != "98a4c7ab-b1fe-361b-ba0b-e307aacfd587" || client.tokens().token.ttl != time.Hour {
+		t.Errorf("Renewed lease not recorded: %+v", client.tokens().token)
+	}
+
+	// expired
+	client.tokens().token.issued = time.Now().Add(-2 * time.Hour)
+	if _, err := client.refreshToken(context.Background()); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if transport.renewals != 1 || transport.logins != 2 {
+		t.Errorf("Expected a login for an expired token, got %d renewals and %d logins", transport.renewals, transport.logins)
+	}
+
+	// a failed renewal falls back to a login
+	transport.failRenewal = true
+	client.tokens().token.issued = time.Now().Add(-client.tokens().token.ttl * 3 / 4)
+	if _, err := client.refreshToken(context.Background()); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if transport.renewals != 2 || transport.logins != 3 {
+		t.Errorf("Expected a login after a failed renewal, got %d renewals and %d logins", transport.renewals, transport.logins)
+	}
+}
+
+func TestTokenForbidden(t *testing.T) {
+	savedDefaultClient := http.DefaultClient
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	transport := &mockTransport{}
+	client := newTokenTestClient(transport)
+
+	if _, err := client.FetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+
+	transport.forbidOnce = true
+	if _, err := client.FetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}); err != nil {
+		t.Fatalf("Request refused with 403 should be retried with a new token: %v", err)
+	}
+	if transport.logins != 2 {
+		t.Errorf("Expected a new login after 403, got %d logins", transport.logins)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	savedDefaultClient := http.DefaultClient
+	defer func() { http.DefaultClient = savedDefaultClient }()
+
+	// the auth method stays in the root namespace
+	transport := &mockTransport{}
+	client := newTokenTestClient(transport)
+	client.Namespace = "team-a"
+
+	if _, err := client.FetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if strings.Join(transport.namespaces, " ") != "/login= /certs=team-a" {
+		t.Errorf("Unexpected namespaces %v", transport.namespaces)
+	}
+
+	transport = &mockTransport{}
+	client = newTokenTestClient(transport)
+	client.Namespace = "team-a"
+	client.AuthNamespace = "admin"
+
+	if _, err := client.FetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}); err != nil {
+		t.Fatalf("Error %v", err)
+	}
+	if strings.Join(transport.namespaces, " ") != "/login=admin /certs=team-a" {
+		t.Errorf("Unexpected namespaces %v", transport.namespaces)
+	}
+
+	// a per-certificate namespace shares the login of the main one
+	transport = &mockTransport{}
+	tokens := &TokenCache{}
+	main := newTokenTestClient(transport)
+	main.Namespace, main.AuthNamespace, main.Tokens = "web", "web", tokens
+	databases := newTokenTestClient(transport)
+	databases.Namespace, databases.AuthNamespace, databases.Tokens = "databases", "web", tokens
+
+	for _, c := range []*Client{main, databases} {
+		if _, err := c.FetchNewCertificate(context.Background(), CertRequest{CommonName: "test.domain.com"}); err != nil {
+			t.Fatalf("Error %v", err)
+		}
+	}
+	if strings.Join(transport.namespaces, " ") != "/login=web /certs=web /certs=databases" {
+		t.Errorf("Unexpected namespaces %v", transport.namespaces)
+	}
+}